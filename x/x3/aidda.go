@@ -2,18 +2,20 @@ package x3
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/emersion/go-message/mail"
 	"github.com/fsnotify/fsnotify"
-	gitignore "github.com/sabhiram/go-gitignore"
-	"github.com/stevegt/envi"
 	. "github.com/stevegt/goadapt"
 	"github.com/stevegt/grokker/v3/core"
 	"github.com/stevegt/grokker/v3/util"
@@ -34,6 +36,18 @@ import (
 
 func Do(args ...string) (err error) {
 	defer Return(&err)
+
+	// parse flags
+	fs := flag.NewFlagSet("aidda", flag.ContinueOnError)
+	fs.Usage = PrintUsageAndExit
+	modeFlag := fs.String("m", "", "mode: code, tests, advice, or custom")
+	timeoutFlag := fs.String("T", "", "test timeout, e.g. 1m")
+	forceFlag := fs.Bool("F", false, "commit even if the quality gate fails")
+	err = fs.Parse(args)
+	if err != nil {
+		PrintUsageAndExit()
+	}
+	args = fs.Args()
 	if len(args) < 1 {
 		PrintUsageAndExit()
 	}
@@ -56,21 +70,40 @@ func Do(args ...string) (err error) {
 	err = os.MkdirAll(dir, 0755)
 	Ck(err)
 
-	// open or create a grokker db
-	g, lock, err := core.LoadOrInit(base, "gpt-4o")
-	Ck(err)
-	defer lock.Unlock()
-
 	// generate filenames
 	promptFn := Spf("%s/prompt", dir)
 	ignoreFn := Spf("%s/ignore", dir)
+	configFn := Spf("%s/config", dir)
+
+	// ensure there is a config file, then load it
+	err = ensureConfigFile(configFn)
+	Ck(err)
+	cfg, err := loadConfig(configFn)
+	Ck(err)
+	if *modeFlag != "" {
+		err = cfg.setMode(*modeFlag)
+		Ck(err)
+	}
+	if *timeoutFlag != "" {
+		err = cfg.setTestTimeout(*timeoutFlag)
+		Ck(err)
+	}
+	if *forceFlag {
+		err = cfg.setGate(gateOff)
+		Ck(err)
+	}
+
+	// open or create a grokker db
+	llm, unlock, err := newGrokkerProvider(base, cfg.Model)
+	Ck(err)
+	defer unlock()
 
 	// ensure there is an ignore file
-	err = ensureIgnoreFile(ignoreFn)
+	err = ensureIgnoreFile(cfg, ignoreFn)
 	Ck(err)
 
 	// create the prompt file if it doesn't exist
-	_, err = NewPrompt(promptFn)
+	_, err = NewPrompt(cfg, promptFn)
 	Ck(err)
 
 	for i := 0; i < len(args); i++ {
@@ -81,20 +114,91 @@ func Do(args ...string) (err error) {
 			// already done by this point, so this is a no-op
 		case "commit":
 			// commit the current state
-			err = commit(g)
+			err = commit(cfg, llm, promptFn)
 			Ck(err)
 		case "prompt":
-			p, err := getPrompt(promptFn)
+			p, err := getPrompt(cfg, promptFn)
 			Ck(err)
 			// spew.Dump(p)
-			err = getChanges(g, p)
+			_, err = getChanges(cfg, llm, p)
+			Ck(err)
+		case "show":
+			err = showPending()
+			Ck(err)
+		case "apply":
+			err = applyPendingInteractive()
+			Ck(err)
+			err = attachLastDiff(promptFn)
+			Ck(err)
+		case "reject":
+			err = rejectPending()
+			Ck(err)
+		case "undo":
+			// optional count
+			n := 1
+			if i+1 < len(args) {
+				count, err := strconv.Atoi(args[i+1])
+				if err == nil {
+					n = count
+					i++
+				}
+			}
+			err = undoInteractive(n)
+			Ck(err)
+		case "branch":
+			i++
+			if i >= len(args) {
+				PrintUsageAndExit()
+			}
+			err = startBranch(args[i])
+			Ck(err)
+		case "finish":
+			dev, err := finishBranch(cfg, llm)
+			Ck(err)
+			res, err := ask(Spf("Delete branch %s?", dev), "n", "y")
+			Ck(err)
+			if strings.ToLower(res) == "y" {
+				err = deleteBranch(dev)
+				Ck(err)
+			}
+		case "provenance":
+			i++
+			if i >= len(args) {
+				PrintUsageAndExit()
+			}
+			err = showProvenance(args[i])
+			Ck(err)
+		case "files":
+			i++
+			if i >= len(args) {
+				PrintUsageAndExit()
+			}
+			err = showFile(cfg, args[i])
+			Ck(err)
+		case "log":
+			err = showHistoryLog()
+			Ck(err)
+		case "replay":
+			i++
+			if i >= len(args) {
+				PrintUsageAndExit()
+			}
+			err = replayHistory(cfg, llm, args[i])
 			Ck(err)
 		case "diff":
-			err = runDiff()
+			err = runDiff(cfg, promptFn)
 			Ck(err)
 		case "test":
-			err = runTest(promptFn)
+			_, _, err = runTest(cfg, promptFn)
+			Ck(err)
+		case "loop":
+			err = runLoop(cfg, llm, promptFn)
 			Ck(err)
+		case "watch":
+			err = watchPrompt(cfg, llm, promptFn)
+			Ck(err)
+		case "config":
+			showConfig(cfg)
 		default:
 			PrintUsageAndExit()
 		}
@@ -104,29 +208,94 @@ func Do(args ...string) (err error) {
 }
 
 func PrintUsageAndExit() {
-	fmt.Println("Usage: go run main.go {subcommand ...}")
+	fmt.Println("Usage: go run main.go [-m mode] [-T test timeout] [-F] {subcommand ...}")
+	fmt.Println("  -F skips the quality gate that runs before each commit")
+	fmt.Println("Modes (-m flag, or Mode header in the prompt file):")
+	fmt.Println("  code    - Write code to make the tests pass")
+	fmt.Println("  tests   - Append tests; only test files are written")
+	fmt.Println("  advice  - Answer the prompt in .aidda/advice.md")
+	fmt.Println("  custom  - Use the sysmsg from the config (default)")
 	fmt.Println("Subcommands:")
-	fmt.Println("  commit  - Commit the current state")
-	fmt.Println("  prompt  - Present the user with an editor to type a prompt and get changes from GPT")
-	fmt.Println("  diff    - Run 'git difftool' to review changes")
+	fmt.Println("  commit  - Commit the current state, if gofmt, go vet, and the linter pass")
+	fmt.Println("  prompt  - Present the user with an editor to type a prompt and stage changes from GPT")
+	fmt.Println("  show    - Show the staged changes as a diff")
+	fmt.Println("  apply   - Apply the staged changes to the working tree")
+	fmt.Println("  reject  - Discard the staged changes")
+	fmt.Println("  undo [n] - Revert the commits holding the last n prompt rounds (default 1)")
+	fmt.Println("  branch {name} - Check out a dev branch and merge the current branch into it")
+	fmt.Println("  finish  - Squash-merge the dev branch back into the branch it was started from")
+	fmt.Println("  provenance {commit} - Show the prompts and responses behind a commit")
+	fmt.Println("  files {path} - Explain why a file is or isn't sent to GPT")
+	fmt.Println("  log     - List the prompt rounds recorded in .aidda/history")
+	fmt.Println("  replay {id} - Re-send a recorded prompt round against the current tree")
+	fmt.Println("  diff    - Run 'git difftool', or the built-in hunk reviewer, to review changes")
 	fmt.Println("  test    - Run tests and include the results in the prompt file")
+	fmt.Println("  loop    - Repeat commit, test, and prompt until tests pass or the budget runs out")
+	fmt.Println("  watch   - Run the watch steps each time the prompt file is saved, until interrupted")
+	fmt.Println("  config  - Show the effective settings and where each came from")
+	fmt.Println("Settings are read from .aidda/config and can be overridden by:")
+	fmt.Println("  AIDDA_MODEL           - model name")
+	fmt.Println("  AIDDA_EDITOR          - editor to open the prompt file with")
+	fmt.Println("  AIDDA_DIFFTOOL        - diff tool command, or 'builtin' for the hunk reviewer")
+	fmt.Println("  AIDDA_TESTCMD         - test command; must produce 'go test -json' output")
+	fmt.Println("  AIDDA_SYSMSG          - system message used in custom mode")
+	fmt.Println("  AIDDA_MODE            - default mode")
+	fmt.Println("  AIDDA_LOOP_ITERATIONS - maximum loop iterations")
+	fmt.Println("  AIDDA_LOOP_TIMEOUT    - maximum loop run time, e.g. 20m")
+	fmt.Println("  AIDDA_TEST_TIMEOUT    - time limit of each test run, e.g. 1m, or 0 for none")
+	fmt.Println("  AIDDA_CONTEXT         - files sent: all, failures for those relevant to failing tests,")
+	fmt.Println("                          or packages for the Go packages around the Out files")
+	fmt.Println("  AIDDA_GATE            - when the quality gate fails: block the commit, prompt to")
+	fmt.Println("                          commit anyway and fix it in the next round, or off")
+	fmt.Println("  AIDDA_LINT            - optional lint command run by the quality gate")
+	fmt.Println("  AIDDA_WATCH           - steps run by watch, from commit, prompt, apply, and test")
+	fmt.Println("  AIDDA_REDACT          - on to mask secrets before sending, or off; extra secret")
+	fmt.Println("                          patterns can be listed one per line in .aidda/redact")
+	fmt.Println("  AIDDA_DISCOVER        - how files are found: walk the tree, applying .gitignore files,")
+	fmt.Println("                          or git to use 'git ls-files'; .aidda/ignore applies on top")
+	fmt.Println("  AIDDA_FIX_ROUNDS      - corrective rounds sent when returned Go files don't compile")
+	fmt.Println("  AIDDA_MAX_FILE_SIZE   - files larger than this many bytes are sent as an outline or")
+	fmt.Println("                          truncated, and aren't written; 0 for no limit")
+	fmt.Println("  AIDDA_IGNORE          - patterns written to a new .aidda/ignore file")
+	fmt.Println("Empty variables are ignored, except AIDDA_LINT= which turns off linting.")
 	os.Exit(1)
 }
 
 // Prompt is a struct that represents a prompt
 type Prompt struct {
+	// In and Out are lists of file patterns; see expandPatterns
 	In  []string
 	Out []string
-	Txt string
+	// Mode is the optional mode for this prompt; see modes.go
+	Mode string
+	Txt  string
+	// Attachments carry machine-generated context such as test
+	// results, kept separate from the user's instructions in Txt
+	Attachments []Attachment
+	// path is the file the prompt was read from, if any
+	path string
+}
+
+// Attachment is a named block of context carried in the prompt file
+type Attachment struct {
+	Name string
+	Body string
 }
 
+// names of the attachments that aidda maintains in the prompt file
+const (
+	attachTestResults = "test-results.txt"
+	attachVet         = "vet.txt"
+	attachDiff        = "last.diff"
+)
+
 // NewPrompt opens or creates a prompt object
-func NewPrompt(path string) (p *Prompt, err error) {
+func NewPrompt(cfg *Config, path string) (p *Prompt, err error) {
 	defer Return(&err)
 	// check if the file exists
 	_, err = os.Stat(path)
 	if os.IsNotExist(err) {
-		err = createPromptFile(path)
+		err = createPromptFile(cfg, path)
 		Ck(err)
 	} else {
 		Ck(err)
@@ -138,7 +307,8 @@ func NewPrompt(path string) (p *Prompt, err error) {
 
 // readPrompt reads a prompt file
 func readPrompt(path string) (p *Prompt, err error) {
-	p = &Prompt{}
+	defer Return(&err)
+	p = &Prompt{path: path}
 	// parse the file as a mail message
 	file, err := os.Open(path)
 	Ck(err)
@@ -149,8 +319,9 @@ func readPrompt(path string) (p *Prompt, err error) {
 	header := mr.Header
 	inStr := header.Get("In")
 	outStr := header.Get("Out")
-	p.In = strings.Split(inStr, ", ")
-	p.Out = strings.Split(outStr, ", ")
+	p.In = splitList(inStr)
+	p.Out = splitList(outStr)
+	p.Mode = strings.TrimSpace(header.Get("Mode"))
 	// read the message body
 	for {
 		part, err := mr.NextPart()
@@ -163,49 +334,157 @@ func readPrompt(path string) (p *Prompt, err error) {
 			// prompt text is in the body
 			buf, err := io.ReadAll(part.Body)
 			Ck(err)
-			// trim leading and trailing whitespace
-			txt := strings.TrimSpace(string(buf))
+			// trim leading and trailing whitespace; MIME line
+			// endings are CRLF
+			txt := strings.TrimSpace(crlfToLf(buf))
 			p.Txt = string(txt)
 		case *mail.AttachmentHeader:
-			// XXX keep this here because we might perhaps use
-			// attachments in the future for e.g. test results
 			filename, err := h.Filename()
 			Ck(err)
-			fmt.Printf("Got attachment: %v\n", filename)
+			buf, err := io.ReadAll(part.Body)
+			Ck(err)
+			p.Attachments = append(p.Attachments, Attachment{Name: filename, Body: crlfToLf(buf)})
 		}
 	}
 	return
 }
 
-// createPromptFile creates a new prompt file
-func createPromptFile(path string) (err error) {
+// crlfToLf converts MIME line endings to Unix line endings
+func crlfToLf(buf []byte) string {
+	return strings.ReplaceAll(string(buf), "\r\n", "\n")
+}
+
+// Attachment returns the body of the named attachment
+func (p *Prompt) Attachment(name string) (body string, ok bool) {
+	for _, a := range p.Attachments {
+		if a.Name == name {
+			return a.Body, true
+		}
+	}
+	return
+}
+
+// SetAttachment adds the named attachment, replacing any existing
+// attachment with the same name
+func (p *Prompt) SetAttachment(name, body string) {
+	for i, a := range p.Attachments {
+		if a.Name == name {
+			p.Attachments[i].Body = body
+			return
+		}
+	}
+	p.Attachments = append(p.Attachments, Attachment{Name: name, Body: body})
+}
+
+// RemoveAttachment removes the named attachment, if any
+func (p *Prompt) RemoveAttachment(name string) {
+	for i, a := range p.Attachments {
+		if a.Name == name {
+			p.Attachments = append(p.Attachments[:i], p.Attachments[i+1:]...)
+			return
+		}
+	}
+}
+
+// writePrompt writes a prompt to a file as a multipart message, with
+// the prompt text in the inline part followed by the attachments
+func writePrompt(path string, p *Prompt) (err error) {
 	defer Return(&err)
 	file, err := os.Create(path)
 	Ck(err)
 	defer file.Close()
 
-	// get the list of files to process
-	inFns, err := getFiles()
-	outFns := inFns[:]
-	inStr := strings.Join(inFns, ", ")
-	outStr := strings.Join(outFns, ", ")
-
 	// create headers
 	hmap := map[string][]string{
-		"In":  []string{inStr},
-		"Out": []string{outStr},
+		"In":  []string{joinList(p.In)},
+		"Out": []string{joinList(p.Out)},
+	}
+	if p.Mode != "" {
+		hmap["Mode"] = []string{p.Mode}
 	}
 	h := mail.HeaderFromMap(hmap)
 
 	// create mail writer
-	mw, err := mail.CreateSingleInlineWriter(file, h)
+	mw, err := mail.CreateWriter(file, h)
 	Ck(err)
-	// Write the body
-	io.WriteString(mw, "# enter prompt here")
 
+	// write the prompt text as 8bit rather than quoted-printable so
+	// the user can edit it as plain text
+	var ih mail.InlineHeader
+	ih.Set("Content-Type", "text/plain; charset=utf-8")
+	ih.Set("Content-Transfer-Encoding", "8bit")
+	tw, err := mw.CreateSingleInline(ih)
+	Ck(err)
+	_, err = io.WriteString(tw, p.Txt+"\n")
+	Ck(err)
+	err = tw.Close()
+	Ck(err)
+
+	// write the attachments
+	for _, a := range p.Attachments {
+		var ah mail.AttachmentHeader
+		ah.Set("Content-Type", "text/plain; charset=utf-8")
+		ah.Set("Content-Transfer-Encoding", "8bit")
+		ah.SetFilename(a.Name)
+		aw, err := mw.CreateAttachment(ah)
+		Ck(err)
+		_, err = io.WriteString(aw, a.Body)
+		Ck(err)
+		err = aw.Close()
+		Ck(err)
+	}
+
+	err = mw.Close()
+	Ck(err)
 	return
 }
 
+// setPromptAttachment sets an attachment in the prompt file
+func setPromptAttachment(promptFn, name, body string) (err error) {
+	defer Return(&err)
+	p, err := readPrompt(promptFn)
+	Ck(err)
+	p.SetAttachment(name, body)
+	err = writePrompt(promptFn, p)
+	Ck(err)
+	return
+}
+
+// createPromptFile creates a new prompt file, noting any files that
+// were left out or will only be sent in part
+func createPromptFile(cfg *Config, path string) (err error) {
+	defer Return(&err)
+
+	// get the list of files to process
+	inFns, binary, err := scanFiles(cfg)
+	Ck(err)
+	oversized, err := oversizedFiles(inFns, cfg.MaxFileSize)
+	Ck(err)
+	var outFns []string
+	for _, fn := range inFns {
+		if !containsFile(oversized, fn) {
+			outFns = append(outFns, fn)
+		}
+	}
+
+	p := &Prompt{
+		In:  inFns,
+		Out: outFns,
+		Txt: "# enter prompt here",
+	}
+	if len(binary) > 0 || len(oversized) > 0 {
+		p.SetAttachment(attachSkippedFiles, skippedFilesText(binary, oversized, cfg.MaxFileSize))
+	}
+	err = writePrompt(path, p)
+	Ck(err)
+
+	return
+}
+
+// stdin is shared by all calls to ask so that buffered input isn't
+// lost between questions, e.g. when answers are piped in
+var stdin = bufio.NewReader(os.Stdin)
+
 // ask asks the user a question and gets a response
 func ask(question, deflt string, others ...string) (response string, err error) {
 	defer Return(&err)
@@ -216,8 +495,7 @@ func ask(question, deflt string, others ...string) (response string, err error)
 	}
 	for {
 		fmt.Printf("%s [%s]: ", question, strings.Join(candidates, "/"))
-		reader := bufio.NewReader(os.Stdin)
-		response, err = reader.ReadString('\n')
+		response, err = stdin.ReadString('\n')
 		Ck(err)
 		response = strings.TrimSpace(response)
 		if response == "" {
@@ -237,40 +515,145 @@ func ask(question, deflt string, others ...string) (response string, err error)
 	}
 }
 
-func runTest(promptFn string) (err error) {
+// runTest runs the tests and go vet and attaches a failure-focused
+// summary of the results to the prompt file.  Failing tests are
+// reported in report and res; err is only set if the tests could not
+// be run at all, or were interrupted.
+func runTest(cfg *Config, promptFn string) (report *TestReport, res *Result, err error) {
 	defer Return(&err)
 	Pf("Running tests\n")
 
-	// run go test -v
-	stdout, stderr, _, _ := RunTee("go test -v")
+	timeout, err := cfg.testTimeout()
+	Ck(err)
+	opts := &RunOpts{Timeout: timeout}
 
-	// append test results to the prompt file
-	fh, err := os.OpenFile(promptFn, os.O_APPEND|os.O_WRONLY, 0644)
+	// run go test -json; a non-zero rc just means that some tests
+	// failed, so we parse the output either way
+	res, err = RunContext(context.Background(), cfg.TestCmd, opts)
 	Ck(err)
-	_, err = fh.WriteString(Spf("\n\nstdout:\n%s\n\nstderr:%s\n\n", stdout, stderr))
+	Assert(!res.Canceled, "tests interrupted")
+	// the events are on stdout; stderr may hold harmless noise such
+	// as "go: downloading ...", so it only counts when the run fails
+	report, err = ParseTestJSON(bytes.NewReader(res.Stdout))
 	Ck(err)
-	fh.Close()
-	return err
+	if !res.Success() {
+		for _, line := range strings.Split(string(res.Stderr), "\n") {
+			if strings.TrimSpace(line) != "" {
+				report.Stray = append(report.Stray, line)
+			}
+		}
+	}
+	summary := report.Summary()
+	switch {
+	case res.TimedOut:
+		summary = Spf("Tests timed out after %s and were killed; results so far:\n%s", timeout, summary)
+	case !res.Success() && report.Passed():
+		// e.g. a test binary that exited early
+		summary = Spf("%s: %s\n%s", cfg.TestCmd, res.Status(), summary)
+	}
+	Pl(summary)
+
+	// run go vet; vet complains on stderr
+	vetRes, err := RunContext(context.Background(), "go vet", opts)
+	Ck(err)
+	Assert(!vetRes.Canceled, "go vet interrupted")
+	vet := strings.TrimSpace(string(vetRes.Stdout) + string(vetRes.Stderr))
+	if vetRes.TimedOut {
+		vet = Spf("go vet timed out after %s and was killed\n%s", timeout, vet)
+	}
+	if vet == "" {
+		vet = "go vet: no problems found"
+	}
+	Pl(vet)
+
+	// attach the results to the prompt file
+	err = setPromptAttachment(promptFn, attachTestResults, summary)
+	Ck(err)
+	err = setPromptAttachment(promptFn, attachVet, vet+"\n")
+	Ck(err)
+	return
+}
+
+// testsPassed returns true if the test command succeeded and reported
+// no failures
+func testsPassed(report *TestReport, res *Result) bool {
+	if !res.Success() {
+		return false
+	}
+	// a test command that doesn't produce 'go test -json' output is
+	// judged by its exit status alone
+	if len(report.Packages) == 0 {
+		return true
+	}
+	return report.Passed()
 }
 
-func runDiff() (err error) {
+// attachLastDiff attaches the uncommitted changes in the working tree to
+// the prompt file so the next round can see what was changed last
+func attachLastDiff(promptFn string) (err error) {
 	defer Return(&err)
+	stdout, err := runOk("git diff", nil)
+	Ck(err)
+	err = setPromptAttachment(promptFn, attachDiff, string(stdout))
+	Ck(err)
+	return
+}
+
+// runDiff runs the configured difftool, or the built-in hunk
+// reviewer if the difftool setting is "builtin"
+func runDiff(cfg *Config, promptFn string) (err error) {
+	defer Return(&err)
+	difftool := cfg.Difftool
+	if difftool == difftoolBuiltin {
+		err = reviewChanges(cfg, promptFn)
+		Ck(err)
+		return
+	}
 	// run difftool
-	difftool := envi.String("AIDDA_DIFFTOOL", "git difftool")
 	Pf("Running difftool %s\n", difftool)
-	var rc int
-	rc, err = RunInteractive(difftool)
+	res, err := RunContext(context.Background(), difftool, &RunOpts{Interactive: true})
 	Ck(err)
-	Assert(rc == 0, "difftool failed")
+	Assert(res.Success(), "difftool %s", res.Status())
 	return err
 }
 
-func getChanges(g *core.Grokker, p *Prompt) (err error) {
+// getChanges sends p to GPT and stages the returned files, or writes
+// the advice in advice mode.  It returns the history record of the
+// round.
+func getChanges(cfg *Config, llm Provider, p *Prompt) (rec *historyRecord, err error) {
 	defer Return(&err)
 
-	prompt := p.Txt
-	inFns := p.In
-	outFns := p.Out
+	// secrets are masked in everything that is sent
+	red, err := newRedactor(cfg)
+	Ck(err)
+	prompt := red.redact("prompt", p.Txt)
+	var attachments []Attachment
+	for _, a := range p.Attachments {
+		attachments = append(attachments, Attachment{Name: a.Name, Body: red.redact(a.Name, a.Body)})
+	}
+	// GPT's last suggested fix, if any, must have been answered
+	decision, err := escalationMsg(p)
+	Ck(err)
+	mode, err := cfg.promptMode(p)
+	Ck(err)
+	Pf("Mode: %s\n", mode)
+	// expand the In and Out patterns against the current tree
+	inFns, outFns, err := expandPromptFiles(cfg, p)
+	Ck(err)
+	outFns, refused := modeOutFns(mode, outFns)
+	if mode == ModeTests && len(refused) > 0 {
+		Pf("Tests mode: not writing non-test files %s\n", strings.Join(refused, ", "))
+	}
+	// never let GPT write outside the tree, or into .git or .aidda
+	outFns, rejected, err := filterWritePaths(outFns)
+	Ck(err)
+	// nor write a file it can't see in full
+	outFns, unsendable, err := filterSendable(outFns, cfg.MaxFileSize)
+	Ck(err)
+	rejected = append(rejected, unsendable...)
+	if mode != ModeAdvice {
+		Assert(len(outFns) > 0, "no files match the Out patterns in %s mode", mode)
+	}
 	var outFls []core.FileLang
 	for _, fn := range outFns {
 		lang, known, err := util.Ext2Lang(fn)
@@ -281,29 +664,152 @@ func getChanges(g *core.Grokker, p *Prompt) (err error) {
 		outFls = append(outFls, core.FileLang{File: fn, Language: lang})
 	}
 
-	sysmsg := "You are an expert Go programmer. Please make the requested changes to the given code."
+	// send only the files the context setting selects
+	inFns, outline, err := selectContext(cfg, p, inFns, outFns)
+	Ck(err)
+	outline = red.redact("outline", outline)
+
+	sysmsg := red.redact("sysmsg", modeSysmsg(cfg, mode, outFns))
 	msgs := []core.ChatMsg{
 		core.ChatMsg{Role: "USER", Txt: prompt},
 	}
+	// forward the attachments as labeled context
+	for _, a := range attachments {
+		txt := Spf("The following is the content of %s, attached for context:\n\n%s", a.Name, a.Body)
+		msgs = append(msgs, core.ChatMsg{Role: "USER", Txt: txt})
+	}
+	if outline != "" {
+		msgs = append(msgs, core.ChatMsg{Role: "USER", Txt: outline})
+	}
+	if len(rejected) > 0 {
+		msgs = append(msgs, core.ChatMsg{Role: "USER", Txt: rejectedWritesText(rejected)})
+	}
+	if decision != "" {
+		msgs = append(msgs, core.ChatMsg{Role: "USER", Txt: decision})
+	}
 
 	// count tokens
 	Pf("Token counts:\n")
-	tcs := newTokenCounts(g)
+	tcs := newTokenCounts(llm)
 	tcs.add("sysmsg", sysmsg)
-	txt := ""
-	for _, m := range msgs {
-		txt += m.Txt
+	tcs.add("prompt", prompt)
+	for i, a := range attachments {
+		tcs.add(a.Name, msgs[i+1].Txt)
+	}
+	if outline != "" {
+		tcs.add("outline", outline)
 	}
-	tcs.add("msgs", txt)
+	texts, views, err := red.redactFiles(inFns, cfg.MaxFileSize)
+	Ck(err)
 	for _, f := range inFns {
-		var buf []byte
-		buf, err = ioutil.ReadFile(f)
-		Ck(err)
-		txt = string(buf)
-		tcs.add(f, txt)
+		tcs.add(f, texts[f])
 	}
 	tcs.showTokenCounts()
+	red.report()
 
+	// edits made while waiting for GPT are conflicts at apply time
+	bases, err := hashFiles(outFns)
+	Ck(err)
+	start := time.Now()
+	resp, received, err := sendRedacted(llm, red, sysmsg, msgs, inFns, outFls, views)
+	Ck(err)
+
+	// record the round
+	rec = &historyRecord{
+		ID:          newHistoryID(),
+		Time:        start,
+		Model:       cfg.Model,
+		Mode:        mode,
+		InPatterns:  p.In,
+		OutPatterns: p.Out,
+		In:          inFns,
+		Out:         outFns,
+		Sysmsg:      sysmsg,
+		Prompt:      prompt,
+		Attachments: attachments,
+		Response:    received,
+		Elapsed:     time.Since(start),
+	}
+	for _, tc := range tcs.counts {
+		rec.TokenCounts = append(rec.TokenCounts, historyTokenCount{Name: tc.name, Count: tc.count})
+	}
+	err = saveHistory(rec)
+	Ck(err)
+
+	if mode == ModeAdvice {
+		// advice never touches source files
+		err = os.WriteFile(adviceFn, []byte(resp), 0644)
+		Ck(err)
+		Pf("Advice written to %s\n", adviceFn)
+		err = clearEscalation(p)
+		Ck(err)
+		return
+	}
+
+	// GPT may suggest a fix instead of following the instructions;
+	// stage nothing until the user decides
+	if sentinel, suggestion := findSentinel(resp); sentinel != "" {
+		return rec, escalate(p, sentinel, suggestion)
+	}
+
+	// stage the returned files rather than writing them over the
+	// working tree
+	staged, undeclared, err := stagePending(outFls, resp, bases, rec.ID)
+	Ck(err)
+
+	// send the errors in the returned Go files back to GPT, up to
+	// fix_rounds times
+	for i := 0; ; i++ {
+		report, err := validateStaged(staged)
+		Ck(err)
+		if report == "" {
+			break
+		}
+		Pf("The returned Go files have errors:\n%s\n", report)
+		if i >= cfg.FixRounds {
+			Pf("Staged the files with their errors after %d corrective rounds\n", i)
+			break
+		}
+		Pf("Sending corrective round %d of %d\n", i+1, cfg.FixRounds)
+		rec.Corrections = append(rec.Corrections, historyCorrection{Response: received, Errors: report})
+		correction := Spf("The files you returned have these errors:\n\n%s\n\nPlease return all of the files again with the errors fixed.", report)
+		msgs = append(msgs,
+			core.ChatMsg{Role: "AI", Txt: received},
+			core.ChatMsg{Role: "USER", Txt: red.redact("correction", correction)},
+		)
+		resp, received, err = sendRedacted(llm, red, sysmsg, msgs, inFns, outFls, views)
+		Ck(err)
+		if sentinel, _ := findSentinel(resp); sentinel != "" {
+			break
+		}
+		staged, undeclared, err = stagePending(outFls, resp, bases, rec.ID)
+		Ck(err)
+	}
+	if len(rec.Corrections) > 0 {
+		rec.Response = received
+		rec.Elapsed = time.Since(start)
+		err = saveHistory(rec)
+		Ck(err)
+	}
+	if sentinel, suggestion := findSentinel(resp); sentinel != "" {
+		// the last staged response still has errors, so drop it
+		err = os.RemoveAll(pendingDir)
+		Ck(err)
+		return rec, escalate(p, sentinel, suggestion)
+	}
+	err = clearEscalation(p)
+	Ck(err)
+
+	err = reportRejectedWrites(p, append(rejected, undeclared...))
+	Ck(err)
+
+	return
+}
+
+// send sends a query to GPT, printing dots while waiting for the
+// response
+func send(llm Provider, sysmsg string, msgs []core.ChatMsg, inFns []string, outFls []core.FileLang) (resp string, err error) {
+	defer Return(&err)
 	Pf("Querying GPT...")
 	// start a goroutine to print dots while waiting for the response
 	var stopDots = make(chan bool)
@@ -319,17 +825,12 @@ func getChanges(g *core.Grokker, p *Prompt) (err error) {
 		}
 	}()
 	start := time.Now()
-	resp, err := g.SendWithFiles(sysmsg, msgs, inFns, outFls)
-	Ck(err)
+	resp, err = llm.Send(sysmsg, msgs, inFns, outFls)
 	elapsed := time.Since(start)
 	stopDots <- true
 	close(stopDots)
-	Pf(" got response in %s\n", elapsed)
-
-	// ExtractFiles(outFls, promptFrag, dryrun, extractToStdout)
-	err = core.ExtractFiles(outFls, resp, false, false)
 	Ck(err)
-
+	Pf(" got response in %s\n", elapsed)
 	return
 }
 
@@ -340,18 +841,18 @@ type tokenCount struct {
 }
 
 type tokenCounts struct {
-	g      *core.Grokker
+	llm    Provider
 	counts []tokenCount
 }
 
 // newTokenCounts creates a new tokenCounts object
-func newTokenCounts(g *core.Grokker) *tokenCounts {
-	return &tokenCounts{g: g}
+func newTokenCounts(llm Provider) *tokenCounts {
+	return &tokenCounts{llm: llm}
 }
 
 // add adds a token count to a tokenCounts object
 func (tcs *tokenCounts) add(name, text string) {
-	count, err := tcs.g.TokenCount(text)
+	count, err := tcs.llm.TokenCount(text)
 	Ck(err)
 	tc := tokenCount{name: name, text: text, count: count}
 	tcs.counts = append(tcs.counts, tc)
@@ -378,7 +879,7 @@ func (tcs *tokenCounts) showTokenCounts() {
 	Pf(format, "total", total)
 }
 
-func getPrompt(promptFn string) (p *Prompt, err error) {
+func getPrompt(cfg *Config, promptFn string) (p *Prompt, err error) {
 	defer Return(&err)
 	var rc int
 
@@ -390,9 +891,13 @@ func getPrompt(promptFn string) (p *Prompt, err error) {
 	err = watcher.Add(promptFn)
 	Ck(err)
 
-	// if AIDDA_EDITOR is set, open the editor where the users can
-	// type a natural language instruction
-	editor := envi.String("AIDDA_EDITOR", "")
+	// GPT may be waiting for an answer to a suggested fix
+	err = askEscalation(promptFn)
+	Ck(err)
+
+	// if an editor is configured, open the editor where the users
+	// can type a natural language instruction
+	editor := cfg.Editor
 	if editor != "" {
 		Pf("Opening editor %s\n", editor)
 		rc, err = RunInteractive(Spf("%s %s", editor, promptFn))
@@ -402,107 +907,107 @@ func getPrompt(promptFn string) (p *Prompt, err error) {
 	if false {
 		// wait for the file to be saved
 		Pf("Waiting for file %s to be saved\n", promptFn)
-		err = waitForFile(watcher, promptFn)
+		err = waitForFile(watcher, promptFn, "")
 		Ck(err)
 	}
 
 	// re-read the prompt file
-	p, err = NewPrompt(promptFn)
+	p, err = NewPrompt(cfg, promptFn)
 	Ck(err)
 
 	return p, err
 }
 
-func commit(g *core.Grokker) (err error) {
+// gitTimeout limits the git commands run by commit, which may run
+// hooks
+const gitTimeout = 10 * time.Minute
+
+// commit commits the current state with a generated message.  The
+// quality gate runs first; see checkGateBeforeCommit.
+func commit(cfg *Config, llm Provider, promptFn string) (err error) {
 	defer Return(&err)
-	var rc int
 	// check git status for uncommitted changes
-	stdout, stderr, rc, err := Run("git status --porcelain", nil)
+	stdout, err := runOk("git status --porcelain", nil)
 	Ck(err)
 	if len(stdout) > 0 {
 		Pl(string(stdout))
-		Pl(string(stderr))
+		err = checkGateBeforeCommit(cfg, promptFn)
+		if errors.Is(err, errGateFailed) {
+			return err
+		}
+		Ck(err)
 		// res, err := ask("There are uncommitted changes. Commit?", "y", "n")
 		// Ck(err)
 		// if res == "y" {
 		if true {
 			// git add
-			rc, err = RunInteractive("git add -A")
-			Assert(rc == 0, "git add failed")
+			res, err := RunContext(context.Background(), "git add -A", &RunOpts{Timeout: gitTimeout})
 			Ck(err)
+			Assert(res.Success(), "git add %s: %s", res.Status(), res.Stderr)
 			// generate a commit message
-			summary, err := g.GitCommitMessage("--staged")
+			summary, err := diffSummary(cfg, llm)
+			Ck(err)
+			// mark the commit as AI-applied if it includes any
+			// applied prompt rounds
+			rounds, err := uncommittedRounds()
 			Ck(err)
+			trailers, err := provenanceTrailers(rounds)
+			Ck(err)
+			summary = addTrailers(summary, trailers)
 			Pl(summary)
 			// git commit
-			stdout, stderr, rc, err := Run("git commit -F-", []byte(summary))
-			Assert(rc == 0, "git commit failed")
+			res, err = RunContext(context.Background(), "git commit -F-",
+				&RunOpts{Stdin: []byte(summary), Timeout: gitTimeout})
+			Ck(err)
+			Pl(string(res.Stdout))
+			Pl(string(res.Stderr))
+			Assert(res.Success(), "git commit %s", res.Status())
+			// link any applied prompt rounds to the commit
+			stdout, err = runOk("git rev-parse HEAD", nil)
+			Ck(err)
+			err = markHistoryCommitted(strings.TrimSpace(string(stdout)))
 			Ck(err)
-			Pl(string(stdout))
-			Pl(string(stderr))
 		}
 	}
 	return err
 }
 
-// getFiles returns a list of files to be processed
-func getFiles() (files []string, err error) {
-	defer Return(&err)
-
-	// get ignore list
-	ignoreFn := ".aidda/ignore"
-	ig, err := gitignore.CompileIgnoreFile(ignoreFn)
-	Ck(err)
-
-	// get list of files recursively
-	files = []string{}
-	err = filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
-		// ignore .git and .aidda directories
-		if strings.Contains(path, ".git") || strings.Contains(path, ".aidda") {
-			return nil
-		}
-		// check if the file is in the ignore list
-		if ig.MatchesPath(path) {
-			return nil
-		}
-		// skip non-files
-		if info.IsDir() {
-			return nil
-		}
-		if !info.Mode().IsRegular() {
-			return nil
-		}
-		// add the file to the list
-		files = append(files, path)
-		return nil
-	})
-	Ck(err)
-	return files, nil
+// getFiles returns a list of files to be processed; see scanFiles
+func getFiles(cfg *Config) (files []string, err error) {
+	files, _, err = scanFiles(cfg)
+	return
 }
 
-// waitForFile waits for a file to be saved
-func waitForFile(watcher *fsnotify.Watcher, fn string) (err error) {
+// waitForFile waits for a file to be saved.  Events for other files
+// in the watched directory are ignored, as are saves that leave the
+// file's hash at skip, such as aidda's own writes; pass "" to wait for
+// any save.
+func waitForFile(watcher *fsnotify.Watcher, fn, skip string) (err error) {
 	defer Return(&err)
 	// wait for the file to be saved
 	for {
 		select {
 		case event, ok := <-watcher.Events:
 			Assert(ok, "watcher.Events closed")
-			Pf("event: %v\n", event)
-			write := event.Op&fsnotify.Write == fsnotify.Write
-			create := event.Op&fsnotify.Create == fsnotify.Create
-			rename := event.Op&fsnotify.Rename == fsnotify.Rename
-			if write || create || rename {
-				Pf("modified file: %s\n", event.Name)
-				// check if absolute path of the file is the same as the
-				// file we are waiting for
-				if filepath.Clean(event.Name) == filepath.Clean(fn) {
-					Pf("file %s written to\n", fn)
-					// wait for writes to finish
-					time.Sleep(1 * time.Second)
-					return
+			// check if the path of the file is the same as the
+			// file we are waiting for
+			if filepath.Clean(event.Name) != filepath.Clean(fn) {
+				continue
+			}
+			if !event.Op.Has(fsnotify.Write) && !event.Op.Has(fsnotify.Create) && !event.Op.Has(fsnotify.Rename) {
+				continue
+			}
+			if skip != "" {
+				hash, err := hashFile(fn)
+				Ck(err)
+				if hash == skip {
+					continue
 				}
 			}
+			Pf("file %s written to\n", fn)
+			// wait for writes to finish
+			time.Sleep(1 * time.Second)
+			return
 		case err, ok := <-watcher.Errors:
 			Assert(ok, "watcher.Errors closed")
 			return err
@@ -510,8 +1015,9 @@ func waitForFile(watcher *fsnotify.Watcher, fn string) (err error) {
 	}
 }
 
-// ensureIgnoreFile creates an ignore file if it doesn't exist
-func ensureIgnoreFile(fn string) (err error) {
+// ensureIgnoreFile creates an ignore file with the patterns of the
+// ignore setting if it doesn't exist
+func ensureIgnoreFile(cfg *Config, fn string) (err error) {
 	defer Return(&err)
 	// check if the ignore file exists
 	_, err = os.Stat(fn)
@@ -522,8 +1028,10 @@ func ensureIgnoreFile(fn string) (err error) {
 		Ck(err)
 		defer fh.Close()
 		// write the default ignore patterns
-		_, err = fh.WriteString(".git\n.idea\n.grok*\ngo.*\nnv.shada\n")
-		Ck(err)
+		for _, pat := range strings.Fields(cfg.Ignore) {
+			_, err = fh.WriteString(pat + "\n")
+			Ck(err)
+		}
 	}
 	return err
 }
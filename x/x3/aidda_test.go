@@ -2,9 +2,14 @@ package x3
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRunTee(t *testing.T) {
@@ -41,6 +46,185 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunContext(t *testing.T) {
+	dir := t.TempDir()
+	res, err := RunContext(context.Background(), "sh -c 'pwd; echo $AIDDA_X; cat'", &RunOpts{
+		Dir:   dir,
+		Env:   []string{"AIDDA_X=x"},
+		Stdin: []byte("in\n"),
+	})
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if !res.Success() {
+		t.Fatalf("Expected success, got: %s", res.Status())
+	}
+	want := dir + "\nx\nin\n"
+	if string(res.Stdout) != want {
+		t.Errorf("Expected %q, got: %q", want, res.Stdout)
+	}
+
+	// output beyond the cap is dropped, with a note
+	res, err = RunContext(context.Background(), "echo 0123456789", &RunOpts{MaxOutput: 4})
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if !strings.HasPrefix(string(res.Stdout), "0123\n[aidda: 7 bytes of output dropped]") {
+		t.Errorf("Unexpected capped output: %q", res.Stdout)
+	}
+}
+
+func TestRunContextResult(t *testing.T) {
+	// a failing command is a result, not an error
+	res, err := RunContext(context.Background(), "sh -c 'echo oops >&2; exit 3'", nil)
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if res.Success() || res.ExitCode != 3 || res.Status() != "exit status 3" {
+		t.Errorf("Unexpected result: %s", res.Status())
+	}
+	if string(res.Stderr) != "oops\n" {
+		t.Errorf("Expected stderr to be captured, got: %q", res.Stderr)
+	}
+
+	res, err = RunContext(context.Background(), "sh -c 'kill -TERM $$'", nil)
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if res.ExitCode != -1 || res.Signal != "terminated" {
+		t.Errorf("Expected the command to be killed by SIGTERM, got: %s", res.Status())
+	}
+
+	// a command that can't be started is an error
+	_, err = RunContext(context.Background(), "aidda-no-such-command", nil)
+	if err == nil {
+		t.Errorf("Expected an error for a missing command")
+	}
+	_, _, _, err = Run("aidda-no-such-command", nil)
+	if err == nil {
+		t.Errorf("Expected Run to fail for a missing command")
+	}
+}
+
+func TestRunContextTimeout(t *testing.T) {
+	// the background sleep holds stdout open, so this only returns
+	// promptly if the whole process group is killed
+	res, err := RunContext(context.Background(), "sh -c 'sleep 30 & sleep 30'", &RunOpts{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	if !res.TimedOut || res.Success() {
+		t.Fatalf("Expected a timeout, got: %s", res.Status())
+	}
+	if res.Duration > 5*time.Second {
+		t.Errorf("Expected the command to be killed promptly, took %s", res.Duration)
+	}
+}
+
+func TestCappedBufferCopies(t *testing.T) {
+	b := &cappedBuffer{max: 64}
+	b.Write([]byte("abc"))
+	got := b.Bytes()
+	// later writes, e.g. from a command still dying after a timeout,
+	// don't show through the returned bytes
+	b.Write([]byte("def"))
+	if string(got) != "abc" {
+		t.Errorf("Expected the bytes returned earlier to stay put, got: %q", got)
+	}
+	got[0] = 'x'
+	if string(b.Bytes()) != "abcdef" {
+		t.Errorf("Expected the buffer to be unchanged, got: %q", b.Bytes())
+	}
+}
+
+func TestTestsPassed(t *testing.T) {
+	pass := &TestReport{Packages: []*PackageResult{{Name: "a", Status: "pass"}}}
+	cases := []struct {
+		report *TestReport
+		res    *Result
+		want   bool
+	}{
+		{pass, &Result{}, true},
+		{pass, &Result{ExitCode: 1}, false},
+		{pass, &Result{TimedOut: true, ExitCode: -1}, false},
+		// non-JSON test commands are judged by exit status
+		{&TestReport{Stray: []string{"ok"}}, &Result{}, true},
+		{&TestReport{Stray: []string{"FAIL"}}, &Result{ExitCode: 2}, false},
+	}
+	for i, c := range cases {
+		if got := testsPassed(c.report, c.res); got != c.want {
+			t.Errorf("case %d: expected %v, got %v", i, c.want, got)
+		}
+	}
+}
+
+func TestRunTestTimeout(t *testing.T) {
+	promptFn := filepath.Join(chdirTemp(t, nil), "prompt")
+	err := createPromptFile(defaultConfig(), promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.TestCmd = "sleep 30"
+	cfg.TestTimeout = "100ms"
+	_, _, err = runTest(cfg, promptFn)
+	if err != nil {
+		t.Fatalf("runTest failed: %v", err)
+	}
+	p, err := readPrompt(promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, _ := p.Attachment(attachTestResults)
+	if !strings.Contains(results, "timed out after 100ms") {
+		t.Errorf("Expected a timeout in the test results, got: %q", results)
+	}
+}
+
+func TestRunTestStderr(t *testing.T) {
+	dir := chdirTemp(t, nil)
+	promptFn := filepath.Join(dir, "prompt")
+	err := createPromptFile(defaultConfig(), promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the test command passes on stdout, chatters on stderr, and
+	// exits with its first argument
+	script := filepath.Join(dir, "test.sh")
+	err = os.WriteFile(script, []byte(`#!/bin/sh
+echo '{"Action":"pass","Package":"example.com/m","Test":"TestA"}'
+echo '{"Action":"pass","Package":"example.com/m"}'
+echo 'go: downloading example.com/dep v1.0.0' >&2
+exit $1
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		rc   int
+		want bool
+	}{
+		// stderr noise doesn't fail a passing run...
+		{0, true},
+		// ...but is reported when the run fails
+		{1, false},
+	}
+	for _, c := range cases {
+		cfg := defaultConfig()
+		cfg.TestCmd = fmt.Sprintf("sh %s %d", quoteArgs(script), c.rc)
+		report, res, err := runTest(cfg, promptFn)
+		if err != nil {
+			t.Fatalf("runTest failed: %v", err)
+		}
+		if got := testsPassed(report, res); got != c.want {
+			t.Errorf("rc %d: expected passed %v, got %v: %q", c.rc, c.want, got, report.Summary())
+		}
+		if got := strings.Contains(report.Summary(), "go: downloading"); got == c.want {
+			t.Errorf("rc %d: expected stderr in the summary %v, got %q", c.rc, !c.want, report.Summary())
+		}
+	}
+}
+
 func TestRunInteractive(t *testing.T) {
 	if os.Getenv("TEST_INTERACTIVE") == "1" {
 		rc, err := RunInteractive("echo Hello, Interactive!")
@@ -62,3 +246,54 @@ func TestRunInteractive(t *testing.T) {
 		t.Errorf("Expected 'Hello, Interactive!' in output, got: %s", stdout)
 	}
 }
+
+func TestPromptAttachments(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "prompt")
+	p := &Prompt{
+		In:  []string{"a.go", "b.go"},
+		Out: []string{"a.go"},
+		Txt: "make the tests pass",
+	}
+	p.SetAttachment(attachTestResults, "Test results: FAIL\n")
+	p.SetAttachment(attachDiff, "diff --git a/a.go b/a.go\n")
+	// replacing an attachment should not add a second one
+	p.SetAttachment(attachTestResults, "Test results: PASS\n")
+	err := writePrompt(fn, p)
+	if err != nil {
+		t.Fatalf("writePrompt failed: %v", err)
+	}
+	got, err := readPrompt(fn)
+	if err != nil {
+		t.Fatalf("readPrompt failed: %v", err)
+	}
+	if got.Txt != p.Txt {
+		t.Errorf("Expected prompt text %q, got: %q", p.Txt, got.Txt)
+	}
+	if strings.Join(got.In, ", ") != "a.go, b.go" || strings.Join(got.Out, ", ") != "a.go" {
+		t.Errorf("Expected In/Out to round-trip, got: %v %v", got.In, got.Out)
+	}
+	if len(got.Attachments) != 2 {
+		t.Fatalf("Expected 2 attachments, got: %d", len(got.Attachments))
+	}
+	body, ok := got.Attachment(attachTestResults)
+	if !ok || body != "Test results: PASS\n" {
+		t.Errorf("Expected replaced test results, got: %q", body)
+	}
+}
+
+func TestReadSinglePartPrompt(t *testing.T) {
+	// prompt files written by older versions are not multipart
+	fn := filepath.Join(t.TempDir(), "prompt")
+	txt := "In: a.go\r\nOut: a.go\r\n\r\ndo the thing\r\n"
+	err := os.WriteFile(fn, []byte(txt), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := readPrompt(fn)
+	if err != nil {
+		t.Fatalf("readPrompt failed: %v", err)
+	}
+	if p.Txt != "do the thing" || len(p.Attachments) != 0 {
+		t.Errorf("Unexpected prompt: %#v", p)
+	}
+}
@@ -0,0 +1,241 @@
+package x3
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// aiddaDir holds aidda's own files, such as the prompt file and the
+// config, which change in every session
+const aiddaDir = ".aidda/"
+
+// setAside holds aidda's own files as they were in the working tree,
+// while git switches branches or reverts commits
+type setAside struct {
+	// files maps each path to its content, or to nil if it was
+	// deleted
+	files map[string][]byte
+}
+
+// ensureClean returns an error if the working tree has uncommitted
+// changes other than to aidda's own files.  Changes to those are set
+// aside, with a copy in the git stash, so git sees a clean tree; the
+// caller puts them back with restore.
+func ensureClean() (aside *setAside, err error) {
+	defer Return(&err)
+	// git status prints paths relative to the top of the repo, which
+	// may be above the current directory
+	prefix, err := gitPrefix()
+	Ck(err)
+	stdout, err := runOk("git status --porcelain -z --untracked-files=all", nil)
+	Ck(err)
+	aside = &setAside{files: make(map[string][]byte)}
+	entries := strings.Split(string(stdout), "\x00")
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		if entry == "" {
+			continue
+		}
+		status, fns := entry[:2], []string{entry[3:]}
+		if status[0] == 'R' || status[0] == 'C' {
+			// the original path follows
+			i++
+			fns = append(fns, entries[i])
+		}
+		for i, fn := range fns {
+			fn, ok := strings.CutPrefix(fn, prefix)
+			Assert(ok && strings.HasPrefix(fn, aiddaDir), "there are uncommitted changes; commit or stash them first")
+			fns[i] = fn
+		}
+		buf, err := os.ReadFile(fns[0])
+		if os.IsNotExist(err) {
+			aside.files[fns[0]] = nil
+			continue
+		}
+		Ck(err)
+		aside.files[fns[0]] = buf
+	}
+	if len(aside.files) > 0 {
+		_, err = runOk("git stash push --quiet --include-untracked -m aidda -- "+aiddaDir, nil)
+		Ck(err)
+	}
+	return
+}
+
+// gitPrefix returns the path of the current directory relative to
+// the top of the repo, with a trailing slash, or "" at the top
+func gitPrefix() (prefix string, err error) {
+	defer Return(&err)
+	stdout, err := runOk("git rev-parse --show-prefix", nil)
+	Ck(err)
+	prefix = strings.TrimSpace(string(stdout))
+	return
+}
+
+// restore puts aidda's files back as they were set aside, and drops
+// their copy from the git stash
+func (aside *setAside) restore() (err error) {
+	defer Return(&err)
+	if len(aside.files) == 0 {
+		return
+	}
+	for fn, buf := range aside.files {
+		if buf == nil {
+			err = os.Remove(fn)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			Ck(err)
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		Ck(err)
+		err = os.WriteFile(fn, buf, 0644)
+		Ck(err)
+	}
+	_, err = runOk("git stash drop --quiet", nil)
+	Ck(err)
+	return
+}
+
+// restoreAside restores aside when a function using it returns,
+// keeping the function's own error if it has one
+func restoreAside(aside *setAside, err *error) {
+	rerr := aside.restore()
+	if *err == nil {
+		*err = rerr
+	}
+}
+
+// currentBranch returns the name of the checked-out branch
+func currentBranch() (branch string, err error) {
+	defer Return(&err)
+	stdout, err := runOk("git branch --show-current", nil)
+	Ck(err)
+	branch = strings.TrimSpace(string(stdout))
+	Assert(branch != "", "HEAD is detached")
+	return
+}
+
+// baseKey returns the git config key that records the branch a dev
+// branch was started from
+func baseKey(branch string) string {
+	return Spf("branch.%s.aiddaBase", branch)
+}
+
+// startBranch checks out the dev branch name, creating it if needed,
+// and merges the current branch into it, as aidda.sh does with -b.
+// The current branch is recorded as the base that finish merges back
+// into.
+func startBranch(name string) (err error) {
+	defer Return(&err)
+	aside, err := ensureClean()
+	Ck(err)
+	defer restoreAside(aside, &err)
+	base, err := currentBranch()
+	Ck(err)
+	Assert(base != name, "already on branch %s", name)
+
+	_, _, rc, err := Run(Spf("git rev-parse --verify --quiet refs/heads/%s", name), nil)
+	Ck(err)
+	if rc != 0 {
+		// the branch doesn't exist yet
+		_, err = runOk(Spf("git checkout -b %s", name), nil)
+		Ck(err)
+	} else {
+		_, err = runOk(Spf("git checkout %s", name), nil)
+		Ck(err)
+		_, err = runOk(Spf("git merge --commit --no-edit %s", base), nil)
+		Ck(err)
+	}
+	_, err = runOk(Spf("git config %s %s", baseKey(name), base), nil)
+	Ck(err)
+	Pf("Working on branch %s; run 'finish' to squash-merge it into %s\n", name, base)
+	return
+}
+
+// finishBranch squash-merges the current dev branch back into the
+// branch it was started from, with a commit message summarizing the
+// squashed changes.  It returns the name of the dev branch, which is
+// left in place.  If the merge conflicts, it is undone, and the dev
+// branch is checked out again.
+func finishBranch(cfg *Config, llm Provider) (dev string, err error) {
+	defer Return(&err)
+	aside, err := ensureClean()
+	Ck(err)
+	defer restoreAside(aside, &err)
+	dev, err = currentBranch()
+	Ck(err)
+	stdout, err := runOk(Spf("git config --get %s", baseKey(dev)), nil)
+	Ck(err, "%s was not started with the branch subcommand", dev)
+	base := strings.TrimSpace(string(stdout))
+
+	_, err = runOk(Spf("git checkout %s", base), nil)
+	Ck(err)
+	_, stderr, rc, err := Run(Spf("git merge --squash %s", dev), nil)
+	Ck(err)
+	if rc != 0 {
+		stdout, err = runOk("git diff --name-only --diff-filter=U", nil)
+		Ck(err)
+		conflicts := strings.Fields(string(stdout))
+		// a squash merge leaves no MERGE_HEAD, so 'git merge
+		// --abort' can't undo it
+		_, err = runOk("git reset --merge", nil)
+		Ck(err)
+		_, err = runOk(Spf("git checkout %s", dev), nil)
+		Ck(err, "the merge into %s was undone, but checking out %s failed; you are on %s", base, dev, base)
+		if len(conflicts) == 0 {
+			Assert(false, "squash-merging %s into %s failed, so the merge was undone; you are on %s:\n%s", dev, base, dev, stderr)
+		}
+		Assert(false, "squash-merging %s into %s conflicts in %s, so the merge was undone; you are on %s.  "+
+			"Merge %s into %s, resolve the conflicts, and run finish again.",
+			dev, base, strings.Join(conflicts, ", "), dev, base, dev)
+	}
+	stdout, err = runOk("git status --porcelain", nil)
+	Ck(err)
+	if len(stdout) == 0 {
+		Pf("Nothing to merge from %s\n", dev)
+		return
+	}
+	summary, err := diffSummary(cfg, llm)
+	Ck(err)
+	// keep the squashed commits' rounds, so provenance and undo still
+	// see the change as applied by aidda
+	trailers, err := branchTrailers(base, dev)
+	Ck(err)
+	summary = addTrailers(summary, trailers)
+	Pl(summary)
+	_, err = runOk("git commit -F-", []byte(summary))
+	Ck(err)
+	Pf("Squash-merged %s into %s\n", dev, base)
+	return
+}
+
+// branchTrailers returns aidda's trailers from the commits on dev
+// that aren't on base, oldest first
+func branchTrailers(base, dev string) (trailers []trailer, err error) {
+	defer Return(&err)
+	stdout, err := runOk(Spf("git log --reverse --format=%%(trailers:only,unfold) %s..%s", base, dev), nil)
+	Ck(err)
+	for _, line := range strings.Split(string(stdout), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.HasPrefix(key, "Aidda-") {
+			continue
+		}
+		trailers = append(trailers, trailer{key, strings.TrimSpace(value)})
+	}
+	return
+}
+
+// deleteBranch deletes a dev branch that has been squash-merged
+func deleteBranch(name string) (err error) {
+	defer Return(&err)
+	// -D because git can't tell that a squash-merged branch is merged
+	_, err = runOk(Spf("git branch -D %s", name), nil)
+	Ck(err)
+	Pf("Deleted branch %s\n", name)
+	return
+}
@@ -0,0 +1,190 @@
+package x3
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestBranchFinish(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	gitInit(t)
+	base, err := currentBranch()
+	if err != nil {
+		t.Fatalf("currentBranch failed: %v", err)
+	}
+
+	err = startBranch("dev")
+	if err != nil {
+		t.Fatalf("startBranch failed: %v", err)
+	}
+	os.WriteFile("a.go", []byte("package a // 1\n"), 0644)
+	gitCommit(t, "one")
+	os.WriteFile("a.go", []byte("package a // 2\n"), 0644)
+	gitCommit(t, addTrailers("two", []trailer{{trailerRound, "r2"}, {trailerModel, "gpt-4o"}}))
+
+	dev, err := finishBranch(defaultConfig(), &scriptedProvider{})
+	if err != nil {
+		t.Fatalf("finishBranch failed: %v", err)
+	}
+	if dev != "dev" {
+		t.Errorf("Expected dev branch, got: %q", dev)
+	}
+	branch, _ := currentBranch()
+	if branch != base {
+		t.Errorf("Expected to be back on %s, got: %s", base, branch)
+	}
+	// the two dev commits are squashed into one
+	out, err := exec.Command("git", "log", "--format=%s").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(out)) != "scripted commit message\ninitial" {
+		t.Errorf("Unexpected log: %q", out)
+	}
+	// and keep the aidda trailers of the squashed commits
+	out, err = exec.Command("git", "log", "-n", "1", "--format=%(trailers)").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "Aidda-Round: r2\nAidda-Model: gpt-4o\n\n" {
+		t.Errorf("Unexpected trailers: %q", out)
+	}
+	if _, err := aiCommits(1); err != nil {
+		t.Errorf("Expected the squash commit to count as applied by aidda, got: %v", err)
+	}
+	err = deleteBranch(dev)
+	if err != nil {
+		t.Fatalf("deleteBranch failed: %v", err)
+	}
+	// finish refuses to run on a branch that wasn't started by aidda
+	_, err = finishBranch(defaultConfig(), &scriptedProvider{})
+	if err == nil {
+		t.Errorf("Expected finishBranch to fail on %s", base)
+	}
+}
+
+func TestBranchBookkeeping(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	gitInit(t)
+	base, _ := currentBranch()
+
+	// aidda changes its own files in every session; those don't
+	// count as uncommitted changes
+	os.WriteFile(".aidda/prompt", []byte("prompt 1\n"), 0644)
+	os.WriteFile(".aidda/ignore", []byte(".git\n"), 0644)
+	err := startBranch("dev")
+	if err != nil {
+		t.Fatalf("startBranch failed: %v", err)
+	}
+	os.WriteFile("a.go", []byte("package a // 1\n"), 0644)
+	gitCommit(t, "one")
+	os.WriteFile(".aidda/prompt", []byte("prompt 2\n"), 0644)
+	_, err = finishBranch(defaultConfig(), &scriptedProvider{})
+	if err != nil {
+		t.Fatalf("finishBranch failed: %v", err)
+	}
+	branch, _ := currentBranch()
+	if branch != base {
+		t.Errorf("Expected to be back on %s, got: %s", base, branch)
+	}
+	got, _ := os.ReadFile(".aidda/prompt")
+	if string(got) != "prompt 2\n" {
+		t.Errorf("Expected the prompt file to be kept, got: %q", got)
+	}
+	out, _ := exec.Command("git", "stash", "list").Output()
+	if len(out) != 0 {
+		t.Errorf("Expected the stash to be dropped, got: %s", out)
+	}
+
+	// other changes still do
+	os.WriteFile("a.go", []byte("package a // 2\n"), 0644)
+	err = startBranch("dev2")
+	if err == nil || !strings.Contains(err.Error(), "uncommitted changes") {
+		t.Errorf("Expected startBranch to refuse a dirty tree, got: %v", err)
+	}
+}
+
+func TestFinishConflict(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	gitInit(t)
+	base, _ := currentBranch()
+	err := startBranch("dev")
+	if err != nil {
+		t.Fatalf("startBranch failed: %v", err)
+	}
+	os.WriteFile("a.go", []byte("package a // dev\n"), 0644)
+	gitCommit(t, "dev")
+	exec.Command("git", "checkout", "-q", base).Run()
+	os.WriteFile("a.go", []byte("package a // base\n"), 0644)
+	gitCommit(t, "base")
+	exec.Command("git", "checkout", "-q", "dev").Run()
+	os.WriteFile(".aidda/prompt", []byte("prompt\n"), 0644)
+
+	_, err = finishBranch(defaultConfig(), &scriptedProvider{})
+	if err == nil || !strings.Contains(err.Error(), "conflicts in a.go") || !strings.Contains(err.Error(), "you are on dev") {
+		t.Fatalf("Expected finishBranch to report the conflict, got: %v", err)
+	}
+	// the merge was undone, and the user is back where they started
+	branch, _ := currentBranch()
+	if branch != "dev" {
+		t.Errorf("Expected to be back on dev, got: %s", branch)
+	}
+	out, _ := exec.Command("git", "status", "--porcelain").Output()
+	if string(out) != "?? .aidda/prompt\n" {
+		t.Errorf("Expected a clean tree apart from the prompt file, got: %q", out)
+	}
+	out, _ = exec.Command("git", "log", "-n", "1", "--format=%s", base).Output()
+	if strings.TrimSpace(string(out)) != "base" {
+		t.Errorf("Expected %s to be unchanged, got: %s", base, out)
+	}
+}
+
+func TestBranchSubdir(t *testing.T) {
+	// aidda runs in a subdirectory of the repo, with its own .aidda
+	chdirTemp(t, map[string]string{
+		"b.go":              "package b\n",
+		"sub/a.go":          "package a\n",
+		"sub/.aidda/ignore": ".git\n",
+	})
+	gitInit(t)
+	err := os.Chdir("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := currentBranch()
+
+	os.WriteFile(".aidda/prompt", []byte("prompt 1\n"), 0644)
+	err = startBranch("dev")
+	if err != nil {
+		t.Fatalf("startBranch failed: %v", err)
+	}
+	os.WriteFile("a.go", []byte("package a // 1\n"), 0644)
+	gitCommit(t, "one")
+	os.WriteFile(".aidda/prompt", []byte("prompt 2\n"), 0644)
+	_, err = finishBranch(defaultConfig(), &scriptedProvider{})
+	if err != nil {
+		t.Fatalf("finishBranch failed: %v", err)
+	}
+	branch, _ := currentBranch()
+	if branch != base {
+		t.Errorf("Expected to be back on %s, got: %s", base, branch)
+	}
+	got, _ := os.ReadFile(".aidda/prompt")
+	if string(got) != "prompt 2\n" {
+		t.Errorf("Expected the prompt file to be kept, got: %q", got)
+	}
+
+	// changes elsewhere in the repo, including another .aidda, still
+	// count
+	for _, fn := range []string{"a.go", "../b.go", "../.aidda/prompt"} {
+		os.WriteFile(fn, []byte("changed\n"), 0644)
+		err = startBranch("dev2")
+		if err == nil || !strings.Contains(err.Error(), "uncommitted changes") {
+			t.Errorf("Expected startBranch to refuse a change to %s, got: %v", fn, err)
+		}
+		exec.Command("git", "checkout", "-q", "--", fn).Run()
+		os.Remove("../.aidda/prompt")
+	}
+}
@@ -0,0 +1,248 @@
+package x3
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// configVersion is the version of the config file format written by
+// this version of aidda
+const configVersion = 1
+
+// Config holds the project settings stored in .aidda/config.  Each
+// field with an env tag can be overridden by that environment
+// variable.
+type Config struct {
+	Version        int    `json:"version"`
+	Model          string `json:"model" env:"AIDDA_MODEL"`
+	Editor         string `json:"editor" env:"AIDDA_EDITOR"`
+	Difftool       string `json:"difftool" env:"AIDDA_DIFFTOOL"`
+	TestCmd        string `json:"testcmd" env:"AIDDA_TESTCMD"`
+	Sysmsg         string `json:"sysmsg" env:"AIDDA_SYSMSG"`
+	Mode           string `json:"mode" env:"AIDDA_MODE"`
+	LoopIterations int    `json:"loop_iterations" env:"AIDDA_LOOP_ITERATIONS"`
+	LoopTimeout    string `json:"loop_timeout" env:"AIDDA_LOOP_TIMEOUT"`
+	Watch          string `json:"watch" env:"AIDDA_WATCH"`
+	TestTimeout    string `json:"test_timeout" env:"AIDDA_TEST_TIMEOUT"`
+	Context        string `json:"context" env:"AIDDA_CONTEXT"`
+	Gate           string `json:"gate" env:"AIDDA_GATE"`
+	Lint           string `json:"lint" env:"AIDDA_LINT"`
+	Redact         string `json:"redact" env:"AIDDA_REDACT"`
+	MaxFileSize    int    `json:"max_file_size" env:"AIDDA_MAX_FILE_SIZE"`
+	Discover       string `json:"discover" env:"AIDDA_DISCOVER"`
+	FixRounds      int    `json:"fix_rounds" env:"AIDDA_FIX_ROUNDS"`
+	// Ignore holds the patterns written to a new .aidda/ignore file,
+	// separated by whitespace
+	Ignore string `json:"ignore" env:"AIDDA_IGNORE"`
+	// sources maps each json key to where its value came from
+	sources map[string]string
+}
+
+// defaultConfig returns the built-in settings
+func defaultConfig() *Config {
+	return &Config{
+		Version:        configVersion,
+		Model:          "gpt-4o",
+		Editor:         "",
+		Difftool:       "git difftool",
+		TestCmd:        "go test -json",
+		Sysmsg:         "You are an expert Go programmer. Please make the requested changes to the given code.",
+		Mode:           ModeCustom,
+		LoopIterations: 10,
+		LoopTimeout:    "20m",
+		Watch:          "commit,prompt,apply,test",
+		TestTimeout:    "10m",
+		Context:        contextAll,
+		Gate:           gateBlock,
+		Lint:           "",
+		Redact:         redactOn,
+		MaxFileSize:    100000,
+		Discover:       discoverWalk,
+		FixRounds:      2,
+		Ignore:         ".git .idea .grok* go.* nv.shada",
+	}
+}
+
+// emptyEnvClears lists the environment variables whose empty value
+// overrides the setting, e.g. AIDDA_LINT= turns off linting.  Other
+// empty variables are ignored.
+var emptyEnvClears = []string{"AIDDA_LINT"}
+
+// loadConfig returns the built-in settings, overridden by the config
+// file at path if it exists, overridden in turn by any environment
+// variables that are set
+func loadConfig(path string) (cfg *Config, err error) {
+	defer Return(&err)
+	cfg = defaultConfig()
+	cfg.sources = make(map[string]string)
+	for _, key := range cfg.keys() {
+		cfg.sources[key] = "default"
+	}
+
+	// read the config file
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+	} else {
+		Ck(err)
+		// unmarshal twice so we know which keys the file sets
+		var raw map[string]json.RawMessage
+		err = json.Unmarshal(buf, &raw)
+		Ck(err, path)
+		err = json.Unmarshal(buf, cfg)
+		Ck(err, path)
+		Assert(cfg.Version <= configVersion, "%s: unsupported config version %d", path, cfg.Version)
+		for key := range raw {
+			cfg.sources[key] = path
+		}
+	}
+
+	// apply environment overrides
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		env := field.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		val, ok := os.LookupEnv(env)
+		if !ok || val == "" && !contains(emptyEnvClears, env) {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String:
+			v.Field(i).SetString(val)
+		case reflect.Int:
+			n, err := strconv.Atoi(val)
+			Ck(err, env)
+			v.Field(i).SetInt(int64(n))
+		}
+		cfg.sources[field.Tag.Get("json")] = Spf("env %s", env)
+	}
+
+	err = cfg.checkRequired()
+	Ck(err)
+	_, err = cfg.loopTimeout()
+	Ck(err)
+	_, err = parseWatchSteps(cfg.Watch)
+	Ck(err)
+	_, err = cfg.testTimeout()
+	Ck(err)
+	err = checkMode(cfg.Mode)
+	Ck(err)
+	err = checkContext(cfg.Context)
+	Ck(err)
+	err = checkGate(cfg.Gate)
+	Ck(err)
+	err = checkRedact(cfg.Redact)
+	Ck(err)
+	err = checkDiscover(cfg.Discover)
+	Ck(err)
+	return
+}
+
+// checkRequired returns an error naming the first setting that must
+// not be empty but is, and where its value came from
+func (cfg *Config) checkRequired() (err error) {
+	defer Return(&err)
+	for _, req := range []struct{ key, val string }{
+		{"model", cfg.Model},
+		{"difftool", cfg.Difftool},
+		{"testcmd", cfg.TestCmd},
+	} {
+		Assert(req.val != "", "%s must not be empty (set by %s)", req.key, cfg.sources[req.key])
+	}
+	return
+}
+
+// sourceFlag is the source of a setting given on the command line
+const sourceFlag = "flag"
+
+// setMode sets the mode from a command line flag, overriding both
+// the config and the prompt's Mode header
+func (cfg *Config) setMode(mode string) (err error) {
+	defer Return(&err)
+	err = checkMode(mode)
+	Ck(err)
+	cfg.Mode = mode
+	cfg.sources["mode"] = sourceFlag
+	return
+}
+
+// setTestTimeout sets the test timeout from a command line flag
+func (cfg *Config) setTestTimeout(timeout string) (err error) {
+	defer Return(&err)
+	cfg.TestTimeout = timeout
+	_, err = cfg.testTimeout()
+	Ck(err)
+	cfg.sources["test_timeout"] = sourceFlag
+	return
+}
+
+// keys returns the json keys of the config fields in order
+func (cfg *Config) keys() (keys []string) {
+	t := reflect.TypeOf(*cfg)
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("json")
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// loopTimeout returns the wall-clock budget of the loop subcommand
+func (cfg *Config) loopTimeout() (timeout time.Duration, err error) {
+	timeout, err = time.ParseDuration(cfg.LoopTimeout)
+	if err != nil {
+		err = fmt.Errorf("loop_timeout: %w", err)
+	}
+	return
+}
+
+// testTimeout returns the time limit of each test run; zero means no
+// limit
+func (cfg *Config) testTimeout() (timeout time.Duration, err error) {
+	timeout, err = time.ParseDuration(cfg.TestTimeout)
+	if err != nil {
+		err = fmt.Errorf("test_timeout: %w", err)
+	}
+	return
+}
+
+// ensureConfigFile creates a config file if it doesn't exist.  The
+// file holds only the format version; the settings the user adds to it
+// override the built-in ones, and the rest keep following the defaults
+// of the aidda version in use.
+func ensureConfigFile(fn string) (err error) {
+	defer Return(&err)
+	_, err = os.Stat(fn)
+	if os.IsNotExist(err) {
+		err = nil
+		buf, err := json.MarshalIndent(map[string]int{"version": configVersion}, "", "    ")
+		Ck(err)
+		err = os.WriteFile(fn, append(buf, '\n'), 0644)
+		Ck(err)
+	}
+	return err
+}
+
+// showConfig prints the effective settings and where each came from
+func showConfig(cfg *Config) {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("json")
+		if key == "" {
+			continue
+		}
+		Pf("%-16s %-40s (%s)\n", key, Spf("%#v", v.Field(i).Interface()), cfg.sources[key])
+	}
+}
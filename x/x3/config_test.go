@@ -0,0 +1,147 @@
+package x3
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(fn, []byte(`{"version": 1, "model": "gpt-4-turbo", "loop_iterations": 3}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AIDDA_LOOP_ITERATIONS", "5")
+	t.Setenv("AIDDA_EDITOR", "vim")
+	cfg, err := loadConfig(fn)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	// the config file overrides the defaults...
+	if cfg.Model != "gpt-4-turbo" || cfg.sources["model"] != fn {
+		t.Errorf("Expected model from config file, got: %q from %q", cfg.Model, cfg.sources["model"])
+	}
+	// ...and the environment overrides the config file
+	if cfg.LoopIterations != 5 || cfg.sources["loop_iterations"] != "env AIDDA_LOOP_ITERATIONS" {
+		t.Errorf("Expected loop_iterations from env, got: %d from %q", cfg.LoopIterations, cfg.sources["loop_iterations"])
+	}
+	if cfg.Editor != "vim" {
+		t.Errorf("Expected editor from env, got: %q", cfg.Editor)
+	}
+	if cfg.Difftool != "git difftool" || cfg.sources["difftool"] != "default" {
+		t.Errorf("Expected default difftool, got: %q from %q", cfg.Difftool, cfg.sources["difftool"])
+	}
+}
+
+func TestLoadConfigVersion(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(fn, []byte(`{"version": 99}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadConfig(fn)
+	if err == nil {
+		t.Errorf("Expected error for unsupported config version")
+	}
+}
+
+func TestEnsureConfigFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config")
+	err := ensureConfigFile(fn)
+	if err != nil {
+		t.Fatalf("ensureConfigFile failed: %v", err)
+	}
+	cfg, err := loadConfig(fn)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.Version != configVersion || cfg.TestCmd != defaultConfig().TestCmd {
+		t.Errorf("Expected defaults to round-trip, got: %#v", cfg)
+	}
+	// the settings still come from the defaults, so later releases
+	// can change them
+	if cfg.sources["testcmd"] != "default" || cfg.sources["model"] != "default" {
+		t.Errorf("Expected settings from the defaults, got: %v", cfg.sources)
+	}
+}
+
+func TestLoadConfigEmptyEnv(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(fn, []byte(`{"version": 1, "lint": "golint ./..."}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an empty variable clears a string setting
+	t.Setenv("AIDDA_LINT", "")
+	cfg, err := loadConfig(fn)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.Lint != "" || cfg.sources["lint"] != "env AIDDA_LINT" {
+		t.Errorf("Expected lint cleared by env, got: %q from %q", cfg.Lint, cfg.sources["lint"])
+	}
+}
+
+func TestLoadConfigEmptyEnvInt(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(fn, []byte(`{"version": 1, "loop_iterations": 3}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an empty variable leaves an int setting alone
+	t.Setenv("AIDDA_LOOP_ITERATIONS", "")
+	cfg, err := loadConfig(fn)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.LoopIterations != 3 || cfg.sources["loop_iterations"] != fn {
+		t.Errorf("Expected loop_iterations from config file, got: %d from %q", cfg.LoopIterations, cfg.sources["loop_iterations"])
+	}
+}
+
+func TestLoadConfigRequired(t *testing.T) {
+	for _, key := range []string{"model", "difftool", "testcmd"} {
+		t.Run(key, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "config")
+			err := os.WriteFile(fn, []byte(`{"version": 1, "`+key+`": ""}`), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = loadConfig(fn)
+			if err == nil || !strings.Contains(err.Error(), key+" must not be empty (set by "+fn+")") {
+				t.Errorf("Expected an error naming %s, got: %v", key, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigEmptyEnvIgnored(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config")
+	// only lint opts in to being cleared by an empty variable
+	for _, env := range []string{"AIDDA_MODEL", "AIDDA_MODE", "AIDDA_CONTEXT", "AIDDA_TEST_TIMEOUT", "AIDDA_SYSMSG"} {
+		t.Setenv(env, "")
+	}
+	cfg, err := loadConfig(fn)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+	if cfg.Sysmsg != defaultConfig().Sysmsg || cfg.sources["sysmsg"] != "default" {
+		t.Errorf("Expected the default sysmsg, got: %q from %q", cfg.Sysmsg, cfg.sources["sysmsg"])
+	}
+}
+
+func TestEnsureIgnoreFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "ignore")
+	cfg := defaultConfig()
+	cfg.Ignore = ".git  vendor\n*.log"
+	err := ensureIgnoreFile(cfg, fn)
+	if err != nil {
+		t.Fatalf("ensureIgnoreFile failed: %v", err)
+	}
+	got, _ := os.ReadFile(fn)
+	if string(got) != ".git\nvendor\n*.log\n" {
+		t.Errorf("Expected the configured patterns, got: %q", got)
+	}
+}
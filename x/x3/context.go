@@ -0,0 +1,246 @@
+package x3
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// context settings select which of the In files are sent to GPT
+const (
+	// contextAll sends every In file
+	contextAll = "all"
+	// contextFailures sends the In files relevant to the current test
+	// failures, and an outline of the rest
+	contextFailures = "failures"
+	// contextPackages sends the In files in the Go packages around
+	// the Out files; see packageContext
+	contextPackages = "packages"
+)
+
+// checkContext returns an error if setting is not a known context
+// setting
+func checkContext(setting string) (err error) {
+	defer Return(&err)
+	switch setting {
+	case contextAll, contextFailures, contextPackages:
+	default:
+		Assert(false, "unknown context %q; expected %s, %s, or %s", setting, contextAll, contextFailures, contextPackages)
+	}
+	return
+}
+
+// contextFile is a file chosen to be sent in full, and why
+type contextFile struct {
+	Fn     string
+	Reason string
+}
+
+// selectContext narrows inFns according to the context setting.  It
+// returns the files to send in full, and an outline of the files left
+// out, if any.
+func selectContext(cfg *Config, p *Prompt, inFns, outFns []string) (selected []string, outline string, err error) {
+	defer Return(&err)
+	var files []contextFile
+	switch cfg.Context {
+	case contextAll:
+		return inFns, "", nil
+	case contextFailures:
+		results, _ := p.Attachment(attachTestResults)
+		files, outline, err = failureContext(inFns, outFns, results)
+		Ck(err)
+	case contextPackages:
+		files, err = packageContext(inFns, outFns)
+		Ck(err)
+	}
+	Pf("Context: sending %d of %d files in full\n", len(files), len(inFns))
+	for _, f := range files {
+		Pf("    %s: %s\n", f.Fn, f.Reason)
+		selected = append(selected, f.Fn)
+	}
+	return
+}
+
+// fileRefRe matches file:line references in compiler output, test
+// logs, and stack traces
+var fileRefRe = regexp.MustCompile(`([\w./\\-]*\.go):\d+`)
+
+// failedTestRe matches the failed tests in a TestReport summary
+var failedTestRe = regexp.MustCompile(`(?m)^--- (?:FAIL|DID NOT FINISH): (\S+)`)
+
+// failureContext picks the files in inFns that are relevant to the
+// failures in results, the test results attached to the prompt: the
+// Out files, files referenced by file:line, the files defining the
+// failing tests, and the files declaring what those tests use.  The
+// rest are summarized in outline.  If results shows no failures,
+// every file is selected.
+func failureContext(inFns, outFns []string, results string) (selected []contextFile, outline string, err error) {
+	defer Return(&err)
+	reasons := make(map[string]string)
+	add := func(fn, reason string) {
+		if _, ok := reasons[fn]; !ok {
+			reasons[fn] = reason
+		}
+	}
+	for _, fn := range outFns {
+		if contains(inFns, fn) {
+			add(fn, "Out file")
+		}
+	}
+
+	// files referenced by file:line
+	found := false
+	for _, m := range fileRefRe.FindAllStringSubmatch(results, -1) {
+		found = true
+		for _, fn := range inFns {
+			if sameFile(fn, m[1]) {
+				add(fn, Spf("referenced at %s", m[0]))
+			}
+		}
+	}
+
+	// the failing tests, and the declarations they use
+	fset := token.NewFileSet()
+	parsed := make(map[string]*ast.File)
+	decls := make(map[string][]string)
+	for _, fn := range inFns {
+		if !strings.HasSuffix(fn, ".go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, fn, nil, parser.SkipObjectResolution)
+		if err != nil {
+			// a file that doesn't parse can still be sent
+			continue
+		}
+		parsed[fn] = f
+		for _, name := range declNames(f) {
+			decls[name] = append(decls[name], fn)
+		}
+	}
+	for _, m := range failedTestRe.FindAllStringSubmatch(results, -1) {
+		found = true
+		test, _, _ := strings.Cut(m[1], "/")
+		for _, fn := range inFns {
+			f, ok := parsed[fn]
+			if !ok {
+				continue
+			}
+			for _, d := range f.Decls {
+				fd, ok := d.(*ast.FuncDecl)
+				if !ok || fd.Recv != nil || fd.Name.Name != test || fd.Body == nil {
+					continue
+				}
+				add(fn, Spf("defines failing test %s", test))
+				ast.Inspect(fd.Body, func(n ast.Node) bool {
+					id, ok := n.(*ast.Ident)
+					if !ok {
+						return true
+					}
+					for _, declFn := range decls[id.Name] {
+						add(declFn, Spf("declares %s, used by %s", id.Name, test))
+					}
+					return true
+				})
+			}
+		}
+	}
+	if !found {
+		for _, fn := range inFns {
+			add(fn, "no failures to select by")
+		}
+	}
+
+	// outline the rest
+	var b strings.Builder
+	for _, fn := range inFns {
+		reason, ok := reasons[fn]
+		if ok {
+			selected = append(selected, contextFile{Fn: fn, Reason: reason})
+			continue
+		}
+		f, ok := parsed[fn]
+		if !ok {
+			Fpf(&b, "%s: left out\n\n", fn)
+			continue
+		}
+		Fpf(&b, "%s:\n%s\n", fn, outlineFile(fset, f))
+	}
+	if b.Len() > 0 {
+		outline = "The following files were left out to save space; their top-level declarations are:\n\n" + b.String()
+	}
+	sort.SliceStable(selected, func(i, j int) bool { return selected[i].Fn < selected[j].Fn })
+	return
+}
+
+// sameFile returns true if fn, a path relative to the top of the
+// tree, is the file referenced by ref, which may be absolute,
+// relative, or just a base name
+func sameFile(fn, ref string) bool {
+	fn = filepath.ToSlash(filepath.Clean(fn))
+	ref = filepath.ToSlash(filepath.Clean(ref))
+	return fn == ref || strings.HasSuffix(ref, "/"+fn) || strings.HasSuffix(fn, "/"+ref)
+}
+
+// contains returns true if s is in list
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// declNames returns the names of the top-level declarations in f
+func declNames(f *ast.File) (names []string) {
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			names = append(names, d.Name.Name)
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					names = append(names, spec.Name.Name)
+				case *ast.ValueSpec:
+					for _, id := range spec.Names {
+						names = append(names, id.Name)
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// outlineFile returns the function signatures and type declarations
+// in f
+func outlineFile(fset *token.FileSet, f *ast.File) string {
+	var b strings.Builder
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			sig := *d
+			sig.Doc = nil
+			sig.Body = nil
+			printer.Fprint(&b, fset, &sig)
+			b.WriteString("\n")
+		case *ast.GenDecl:
+			if d.Tok != token.TYPE {
+				continue
+			}
+			decl := *d
+			decl.Doc = nil
+			printer.Fprint(&b, fset, &decl)
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
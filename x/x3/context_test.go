@@ -0,0 +1,124 @@
+package x3
+
+import (
+	"strings"
+	"testing"
+)
+
+// contextFiles is a small package with one failing test
+var contextFiles = map[string]string{
+	"a.go":      "package a\n\n// Add adds\nfunc Add(x, y int) int { return x - y }\n",
+	"b.go":      "package a\n\ntype B struct{ N int }\n\nfunc (b *B) Inc() { b.N++ }\n",
+	"c.go":      "package a\n\nfunc C() {}\n",
+	"a_test.go": "package a\n\nimport \"testing\"\n\nfunc TestAdd(t *testing.T) {\n\tif Add(1, 2) != 3 {\n\t\tt.Fatal(\"bad\")\n\t}\n}\n",
+	"README.md": "# a\n",
+}
+
+func TestFailureContext(t *testing.T) {
+	chdirTemp(t, contextFiles)
+	inFns := []string{"README.md", "a.go", "a_test.go", "b.go", "c.go"}
+	results := "Test results: FAIL (0 passed, 1 failed, 0 skipped)\n\n" +
+		"FAIL example.com/a (0s)\n--- FAIL: TestAdd/sub (0s)\n    a_test.go:7: bad\n"
+	selected, outline, err := failureContext(inFns, nil, results)
+	if err != nil {
+		t.Fatalf("failureContext failed: %v", err)
+	}
+	var fns []string
+	for _, f := range selected {
+		fns = append(fns, f.Fn)
+	}
+	if strings.Join(fns, ",") != "a.go,a_test.go" {
+		t.Errorf("Expected a.go and a_test.go, got: %v", selected)
+	}
+	if selected[0].Reason != "declares Add, used by TestAdd" {
+		t.Errorf("Unexpected reason for a.go: %q", selected[0].Reason)
+	}
+	for _, want := range []string{"README.md: left out", "type B struct", "func (b *B) Inc()", "func C()"} {
+		if !strings.Contains(outline, want) {
+			t.Errorf("Expected outline to contain %q, got: %q", want, outline)
+		}
+	}
+	if strings.Contains(outline, "b.N++") {
+		t.Errorf("Expected outline to omit function bodies, got: %q", outline)
+	}
+
+	// build errors reference files by path, and Out files are
+	// always sent
+	results = "Test results: FAIL (0 passed, 0 failed, 0 skipped)\n\nBuild output:\n    ./b.go:5:22: undefined: x\n"
+	selected, _, err = failureContext(inFns, []string{"c.go"}, results)
+	if err != nil {
+		t.Fatalf("failureContext failed: %v", err)
+	}
+	if len(selected) != 2 || selected[0].Fn != "b.go" || selected[1].Reason != "Out file" {
+		t.Errorf("Expected b.go and c.go, got: %v", selected)
+	}
+
+	// without failures, everything is sent
+	selected, outline, err = failureContext(inFns, nil, "Test results: PASS (1 passed, 0 failed, 0 skipped)\n")
+	if err != nil {
+		t.Fatalf("failureContext failed: %v", err)
+	}
+	if len(selected) != len(inFns) || outline != "" {
+		t.Errorf("Expected all files and no outline, got: %v, %q", selected, outline)
+	}
+}
+
+func TestGetChangesFailureContext(t *testing.T) {
+	chdirTemp(t, contextFiles)
+	cfg := defaultConfig()
+	cfg.Context = contextFailures
+	llm := &scriptedProvider{responses: []string{fileResponse("a.go", "go", contextFiles["a.go"])}}
+	p := &Prompt{In: []string{"*.go"}, Out: []string{"a.go"}, Txt: "fix Add"}
+	p.SetAttachment(attachTestResults, "--- FAIL: TestAdd (0s)\n")
+	_, err := getChanges(cfg, llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	req := llm.requests[0]
+	if strings.Join(req.inFns, ",") != "a.go,a_test.go" {
+		t.Errorf("Expected only the relevant files to be sent, got: %v", req.inFns)
+	}
+	last := req.msgs[len(req.msgs)-1].Txt
+	if !strings.Contains(last, "func C()") {
+		t.Errorf("Expected an outline of the other files, got: %q", last)
+	}
+}
+
+func TestPackageContext(t *testing.T) {
+	// go list must see the temporary module, not any workspace
+	t.Setenv("GOWORK", "off")
+	chdirTemp(t, map[string]string{
+		"go.mod":       "module example.com/m\n\ngo 1.21\n",
+		"a/a.go":       "package a\n\nimport \"example.com/m/b\"\n\nvar A = b.B\n",
+		"a/a_test.go":  "package a\n",
+		"b/b.go":       "package b\n\nvar B = 1\n",
+		"c/c.go":       "package c\n\nimport \"example.com/m/a\"\n\nvar C = a.A\n",
+		"d/d.go":       "package d\n",
+		"a/README.md":  "# a\n",
+		"cmd/x/x.go":   "package main\n\nimport _ \"example.com/m/d\"\n\nfunc main() {}\n",
+		"c/c_test.go":  "package c_test\n\nimport _ \"example.com/m/c\"\n",
+		"a/new_doc.md": "",
+	})
+	inFns, err := getFiles(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected, err := packageContext(inFns, []string{"a/a.go"})
+	if err != nil {
+		t.Fatalf("packageContext failed: %v", err)
+	}
+	var got []string
+	for _, f := range selected {
+		got = append(got, f.Fn+": "+f.Reason)
+	}
+	want := []string{
+		"a/a.go: Out file",
+		"a/a_test.go: in package example.com/m/a with an Out file",
+		"b/b.go: in package example.com/m/b, imported by example.com/m/a",
+		"c/c.go: in package example.com/m/c, which imports example.com/m/a",
+		"c/c_test.go: in package example.com/m/c, which imports example.com/m/a",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
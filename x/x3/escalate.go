@@ -0,0 +1,169 @@
+package x3
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// sentinels GPT prints on a line by itself when it can't follow the
+// instructions; see sysmsgCode and sysmsgTests
+const (
+	sentinelTestError = "TESTERROR"
+	sentinelCodeError = "CODEERROR"
+)
+
+// attachEscalation is the name of the prompt attachment that carries
+// GPT's suggested fix and the user's answer to it
+const attachEscalation = "escalation.txt"
+
+// answers to an escalation
+const (
+	answerAccept = "accept"
+	answerReject = "reject"
+)
+
+// errEscalated is returned by getChanges when GPT responds with a
+// sentinel instead of changes
+var errEscalated = errors.New("GPT suggested a fix instead of making changes; answer it in " + attachEscalation + " in the prompt file")
+
+// sentinelRe matches a sentinel line, as aidda.sh does
+var sentinelRe = regexp.MustCompile(`(?m)^[ \t]*(TESTERROR|CODEERROR)[ \t]*$`)
+
+// answerRe matches the line of the escalation attachment where the
+// user answers
+var answerRe = regexp.MustCompile(`(?m)^Answer:[ \t]*(.*?)[ \t]*$`)
+
+// findSentinel returns the first sentinel in resp, and the rest of
+// resp, which holds GPT's suggested fix.  The sentinel is "" if there
+// is none.
+func findSentinel(resp string) (sentinel, suggestion string) {
+	m := sentinelRe.FindStringSubmatch(resp)
+	if m == nil {
+		return "", ""
+	}
+	suggestion = strings.TrimSpace(sentinelRe.ReplaceAllString(resp, ""))
+	return m[1], suggestion
+}
+
+// escalate records GPT's suggested fix in the prompt file that p was
+// read from, if any, and returns errEscalated
+func escalate(p *Prompt, sentinel, suggestion string) (err error) {
+	defer Return(&err)
+	body := escalationText(sentinel, suggestion)
+	Pf("%s", body)
+	if p.path != "" {
+		err = setPromptAttachment(p.path, attachEscalation, body)
+		Ck(err)
+	}
+	return errEscalated
+}
+
+// escalationText returns the body of the escalation attachment, which
+// asks the user to accept or reject GPT's suggested fix
+func escalationText(sentinel, suggestion string) string {
+	var b strings.Builder
+	switch sentinel {
+	case sentinelTestError:
+		Fpf(&b, "GPT said %s: it thinks the tests are wrong, and suggests:\n\n", sentinel)
+	default:
+		Fpf(&b, "GPT said %s: it thinks the code is wrong or needs something from you, and suggests:\n\n", sentinel)
+	}
+	Fpf(&b, "%s\n\n", suggestion)
+	Fpf(&b, "No changes were staged.  To go on, set the answer below to %s or %s.\n\n", answerAccept, answerReject)
+	b.WriteString("Answer: \n")
+	return b.String()
+}
+
+// escalationAnswer returns the answer in the body of the escalation
+// attachment, or "" if there is none yet
+func escalationAnswer(body string) (answer string, err error) {
+	defer Return(&err)
+	m := answerRe.FindAllStringSubmatch(body, -1)
+	if m == nil {
+		return "", nil
+	}
+	switch strings.ToLower(m[len(m)-1][1]) {
+	case "":
+		return "", nil
+	case answerAccept, "a", "y", "yes":
+		return answerAccept, nil
+	case answerReject, "r", "n", "no":
+		return answerReject, nil
+	}
+	Assert(false, "%s: unknown answer %q; expected %s or %s", attachEscalation, m[len(m)-1][1], answerAccept, answerReject)
+	return
+}
+
+// setEscalationAnswer returns body with its answer set
+func setEscalationAnswer(body, answer string) string {
+	return answerRe.ReplaceAllLiteralString(body, "Answer: "+answer)
+}
+
+// escalationMsg returns the message that tells GPT what the user
+// decided about its suggested fix, if it suggested one.  A suggested
+// fix that hasn't been answered is an error.
+func escalationMsg(p *Prompt) (msg string, err error) {
+	defer Return(&err)
+	body, ok := p.Attachment(attachEscalation)
+	if !ok {
+		return "", nil
+	}
+	answer, err := escalationAnswer(body)
+	Ck(err)
+	switch answer {
+	case answerAccept:
+		msg = "I accept the fix you suggested in " + attachEscalation + "; make it now."
+	case answerReject:
+		msg = "I reject the fix you suggested in " + attachEscalation + "; follow the instructions without it."
+	default:
+		Assert(false, "GPT's suggested fix is waiting for an answer; set the Answer line of %s in the prompt file to %s or %s",
+			attachEscalation, answerAccept, answerReject)
+	}
+	return
+}
+
+// clearEscalation removes an answered suggested fix from the prompt
+// file that p was read from, once GPT has seen the answer
+func clearEscalation(p *Prompt) (err error) {
+	defer Return(&err)
+	if _, ok := p.Attachment(attachEscalation); !ok || p.path == "" {
+		return
+	}
+	current, err := readPrompt(p.path)
+	Ck(err)
+	current.RemoveAttachment(attachEscalation)
+	err = writePrompt(p.path, current)
+	Ck(err)
+	return
+}
+
+// askEscalation asks the user to accept or reject a suggested fix
+// that hasn't been answered yet, and records the answer in the prompt
+// file
+func askEscalation(promptFn string) (err error) {
+	defer Return(&err)
+	p, err := readPrompt(promptFn)
+	Ck(err)
+	body, ok := p.Attachment(attachEscalation)
+	if !ok {
+		return
+	}
+	answer, err := escalationAnswer(body)
+	Ck(err)
+	if answer != "" {
+		return
+	}
+	Pl(body)
+	res, err := ask("Accept GPT's suggested fix?", "n", "y")
+	Ck(err)
+	answer = answerReject
+	if strings.ToLower(res) == "y" {
+		answer = answerAccept
+	}
+	err = setPromptAttachment(promptFn, attachEscalation, setEscalationAnswer(body, answer))
+	Ck(err)
+	return
+}
@@ -0,0 +1,94 @@
+package x3
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFindSentinel(t *testing.T) {
+	sentinel, suggestion := findSentinel("The test expects 3, but 1+1 is 2.\n  TESTERROR  \nChange the test to expect 2.\n")
+	if sentinel != sentinelTestError || suggestion != "The test expects 3, but 1+1 is 2.\n\nChange the test to expect 2." {
+		t.Errorf("unexpected sentinel %q and suggestion %q", sentinel, suggestion)
+	}
+	// only a line by itself counts
+	if sentinel, _ := findSentinel("if err == CODEERROR {\n"); sentinel != "" {
+		t.Errorf("expected no sentinel, got %q", sentinel)
+	}
+	body := escalationText(sentinelCodeError, "fix it")
+	for _, c := range []struct{ in, want string }{{"", ""}, {"Accept", answerAccept}, {"n", answerReject}} {
+		got, err := escalationAnswer(setEscalationAnswer(body, c.in))
+		if err != nil || got != c.want {
+			t.Errorf("%q: expected %q, got %q %v", c.in, c.want, got, err)
+		}
+	}
+	_, err := escalationAnswer(setEscalationAnswer(body, "maybe"))
+	if err == nil {
+		t.Errorf("expected an error for an unknown answer")
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n", "a_test.go": "package a\n"})
+	suggestion := "The test expects Add(1, 1) to be 3; it should be 2."
+	good := fileResponse("a.go", "go", "package a // fixed\n")
+	llm := &scriptedProvider{responses: []string{"TESTERROR\n" + suggestion + "\n", good}}
+	p := &Prompt{In: []string{"*.go"}, Out: []string{"a.go"}, Txt: "make the tests pass", path: "prompt"}
+	err := writePrompt(p.path, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is staged, and the suggestion is put to the user
+	_, err = getChanges(defaultConfig(), llm, p)
+	if !errors.Is(err, errEscalated) {
+		t.Fatalf("expected errEscalated, got %v", err)
+	}
+	manifest, err := readPending()
+	if err != nil || manifest != nil {
+		t.Fatalf("expected nothing staged, got %#v %v", manifest, err)
+	}
+	p, err = readPrompt("prompt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, ok := p.Attachment(attachEscalation)
+	if !ok || !strings.Contains(body, suggestion) || !strings.Contains(body, "tests are wrong") {
+		t.Fatalf("expected the suggestion in the prompt file, got %q", body)
+	}
+
+	// no more rounds until the user answers
+	_, err = getChanges(defaultConfig(), llm, p)
+	if err == nil || !strings.Contains(err.Error(), "waiting for an answer") {
+		t.Fatalf("expected an unanswered escalation to be an error, got %v", err)
+	}
+	if len(llm.requests) != 1 {
+		t.Fatalf("expected no request to be sent, got %d", len(llm.requests))
+	}
+
+	// the answer is sent to GPT, and cleared once it has been
+	p.SetAttachment(attachEscalation, setEscalationAnswer(body, answerAccept))
+	err = writePrompt(p.path, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = getChanges(defaultConfig(), llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	msgs := llm.requests[1].msgs
+	if !strings.Contains(msgs[len(msgs)-1].Txt, "I accept the fix") {
+		t.Errorf("expected the answer to be sent, got %#v", msgs)
+	}
+	p, err = readPrompt("prompt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Attachment(attachEscalation); ok {
+		t.Errorf("expected the escalation to be cleared")
+	}
+	manifest, err = readPending()
+	if err != nil || manifest == nil {
+		t.Errorf("expected the change to be staged, got %v", err)
+	}
+}
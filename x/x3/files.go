@@ -0,0 +1,433 @@
+package x3
+
+import (
+	"bytes"
+	"context"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/core"
+)
+
+// attachSkippedFiles is the name of the prompt attachment, added by
+// createPromptFile, that lists the files left out of In and Out or
+// sent only in part
+const attachSkippedFiles = "skipped-files.txt"
+
+// sniffSize is how much of a file is read to decide whether it is
+// binary
+const sniffSize = 8000
+
+// skippedFile is a file left out of the prompt, or sent only in part,
+// and why
+type skippedFile struct {
+	Path   string
+	Reason string
+}
+
+// isBinary returns true if fn looks like a binary file:  its first
+// sniffSize bytes contain a NUL or aren't valid UTF-8
+func isBinary(fn string) (binary bool, err error) {
+	defer Return(&err)
+	file, err := os.Open(fn)
+	Ck(err)
+	defer file.Close()
+	buf := make([]byte, sniffSize)
+	n, err := io.ReadFull(file, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	Ck(err)
+	buf = buf[:n]
+	if bytes.IndexByte(buf, 0) >= 0 {
+		return true, nil
+	}
+	if n == sniffSize {
+		// don't count a character cut in half at the end
+		for i := 0; i < utf8.UTFMax && len(buf) > 0 && !utf8.Valid(buf); i++ {
+			buf = buf[:len(buf)-1]
+		}
+	}
+	return !utf8.Valid(buf), nil
+}
+
+// discover settings choose how the files in the tree are found
+const (
+	// discoverWalk walks the tree, applying any .gitignore files
+	discoverWalk = "walk"
+	// discoverGit asks git for the tracked files and the untracked
+	// files it doesn't ignore
+	discoverGit = "git"
+)
+
+// checkDiscover returns an error if setting is not a known discover
+// setting
+func checkDiscover(setting string) (err error) {
+	defer Return(&err)
+	switch setting {
+	case discoverWalk, discoverGit:
+	default:
+		Assert(false, "unknown discover setting %q; expected %s or %s", setting, discoverWalk, discoverGit)
+	}
+	return
+}
+
+// inProtectedDir returns the protected directory fn is in, or ""
+func inProtectedDir(fn string) string {
+	for _, part := range strings.Split(fn, "/") {
+		if contains(protectedDirs, part) {
+			return part
+		}
+	}
+	return ""
+}
+
+// gitFiles returns the files git tracks, and the untracked files it
+// doesn't ignore, under the given paths, or in the whole tree if none
+// are given
+func gitFiles(paths ...string) (files []string, err error) {
+	defer Return(&err)
+	command := "git ls-files -z --cached --others --exclude-standard"
+	if len(paths) > 0 {
+		command += " -- " + quoteArgs(paths...)
+	}
+	stdout, err := runOk(command, nil)
+	Ck(err)
+	// a file that is both tracked and modified is listed twice
+	seen := make(map[string]bool)
+	for _, fn := range strings.Split(string(stdout), "\x00") {
+		if fn != "" && !seen[fn] {
+			seen[fn] = true
+			files = append(files, fn)
+		}
+	}
+	// the untracked files are listed first
+	sort.Strings(files)
+	return
+}
+
+// walkFiles returns the regular files in the tree, leaving out the
+// directories that rules ignore
+func walkFiles(rules *ignoreRules) (files []string, err error) {
+	defer Return(&err)
+	err = filepath.WalkDir(".", func(fn string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fn = filepath.ToSlash(fn)
+		if !d.IsDir() {
+			files = append(files, fn)
+			return nil
+		}
+		if fn == "." {
+			return nil
+		}
+		if contains(protectedDirs, d.Name()) {
+			return filepath.SkipDir
+		}
+		rule, err := rules.check(fn, true)
+		if err != nil {
+			return err
+		}
+		if rule != nil && !rule.Negate {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	Ck(err)
+	return
+}
+
+// checkCandidate decides whether fn, a file found by walkFiles or
+// gitFiles, is left out by the ignore files, and why.  Binary files
+// are left to the caller.
+func checkCandidate(rules *ignoreRules, fn string) (included bool, reason string, err error) {
+	defer Return(&err)
+	if dir := inProtectedDir(fn); dir != "" {
+		return false, Spf("inside %s", dir), nil
+	}
+	rule, dir, err := rules.ignored(fn, false)
+	Ck(err)
+	if rule != nil && !rule.Negate {
+		if dir != "" {
+			return false, Spf("in %s, which matches %s", dir, rule), nil
+		}
+		return false, Spf("matches %s", rule), nil
+	}
+	if rule != nil {
+		reason = Spf("re-included by %s", rule)
+	}
+	info, err := os.Lstat(fn)
+	if os.IsNotExist(err) {
+		// e.g. a tracked file that has been deleted
+		return false, "does not exist", nil
+	}
+	Ck(err)
+	if !info.Mode().IsRegular() {
+		return false, "not a regular file", nil
+	}
+	return true, reason, nil
+}
+
+// binaryReason returns why fn, a regular file, is left out for being
+// binary, or "" if it isn't binary
+func binaryReason(fn string) (reason string, err error) {
+	defer Return(&err)
+	binary, err := isBinary(fn)
+	Ck(err)
+	if !binary {
+		return "", nil
+	}
+	info, err := os.Stat(fn)
+	Ck(err)
+	return Spf("binary, %d bytes", info.Size()), nil
+}
+
+// scanFiles returns the files in the tree that can be sent to GPT,
+// found according to the discover setting and filtered by the ignore
+// files.  Binary files are returned in skipped instead.
+func scanFiles(cfg *Config) (files []string, skipped []skippedFile, err error) {
+	defer Return(&err)
+	// git has already applied the .gitignore files to what it lists
+	rules, err := newIgnoreRules(cfg.Discover == discoverWalk)
+	Ck(err)
+	var candidates []string
+	switch cfg.Discover {
+	case discoverWalk:
+		candidates, err = walkFiles(rules)
+		Ck(err)
+	case discoverGit:
+		candidates, err = gitFiles()
+		Ck(err)
+	}
+	files = []string{}
+	for _, fn := range candidates {
+		included, _, err := checkCandidate(rules, fn)
+		Ck(err)
+		if !included {
+			continue
+		}
+		reason, err := binaryReason(fn)
+		Ck(err)
+		if reason != "" {
+			skipped = append(skipped, skippedFile{Path: fn, Reason: reason})
+			continue
+		}
+		files = append(files, fn)
+	}
+	return
+}
+
+// explainFile says whether fn would be sent to GPT, and why
+func explainFile(cfg *Config, fn string) (included bool, reason string, err error) {
+	defer Return(&err)
+	fn = filepath.ToSlash(filepath.Clean(fn))
+	info, err := os.Lstat(fn)
+	if os.IsNotExist(err) {
+		return false, "does not exist", nil
+	}
+	Ck(err)
+	if info.IsDir() {
+		return false, "is a directory", nil
+	}
+	if dir := inProtectedDir(fn); dir != "" {
+		return false, Spf("inside %s", dir), nil
+	}
+	var reasons []string
+	if cfg.Discover == discoverGit {
+		listed, err := gitFiles(fn)
+		Ck(err)
+		if len(listed) == 0 {
+			res, err := RunContext(context.Background(), "git check-ignore -v -- "+quoteArgs(fn), nil)
+			Ck(err)
+			// e.g. ".gitignore:3:*.log<TAB>x.log"
+			src, _, _ := strings.Cut(strings.TrimSpace(string(res.Stdout)), "\t")
+			if src != "" {
+				return false, Spf("ignored by git, at %s", src), nil
+			}
+			return false, "not listed by git ls-files", nil
+		}
+		reasons = append(reasons, "listed by git ls-files")
+	}
+	rules, err := newIgnoreRules(cfg.Discover == discoverWalk)
+	Ck(err)
+	included, reason, err = checkCandidate(rules, fn)
+	Ck(err)
+	if !included {
+		return false, reason, nil
+	}
+	binary, err := binaryReason(fn)
+	Ck(err)
+	if binary != "" {
+		return false, binary, nil
+	}
+	if reason != "" {
+		reasons = append(reasons, reason)
+	}
+	if cfg.MaxFileSize > 0 && info.Size() > int64(cfg.MaxFileSize) {
+		reasons = append(reasons, Spf("larger than max_file_size (%d bytes), so it is sent as an outline or truncated, and can't be written", cfg.MaxFileSize))
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, "not ignored")
+	}
+	return true, strings.Join(reasons, "; "), nil
+}
+
+// showFile prints whether fn would be sent to GPT, and why
+func showFile(cfg *Config, fn string) (err error) {
+	defer Return(&err)
+	included, reason, err := explainFile(cfg, fn)
+	Ck(err)
+	if included {
+		Pf("%s: included: %s\n", fn, reason)
+	} else {
+		Pf("%s: excluded: %s\n", fn, reason)
+	}
+	return
+}
+
+// containsFile returns true if fn is in files
+func containsFile(files []skippedFile, fn string) bool {
+	for _, f := range files {
+		if f.Path == fn {
+			return true
+		}
+	}
+	return false
+}
+
+// oversizedFiles returns the files in fns that are larger than
+// maxSize, and so are sent only in part; see fileView
+func oversizedFiles(fns []string, maxSize int) (oversized []skippedFile, err error) {
+	defer Return(&err)
+	if maxSize <= 0 {
+		return
+	}
+	for _, fn := range fns {
+		info, err := os.Stat(fn)
+		Ck(err)
+		if info.Size() > int64(maxSize) {
+			oversized = append(oversized, skippedFile{Path: fn, Reason: Spf("%d bytes", info.Size())})
+		}
+	}
+	return
+}
+
+// skippedFilesText describes the binary and oversized files for the
+// prompt file
+func skippedFilesText(binary, oversized []skippedFile, maxSize int) string {
+	var b strings.Builder
+	if len(binary) > 0 {
+		b.WriteString("The following files look binary, so they are not listed in In or Out:\n")
+		for _, f := range binary {
+			Fpf(&b, "    %s: %s\n", f.Path, f.Reason)
+		}
+	}
+	if len(oversized) > 0 {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		Fpf(&b, "The following files are larger than max_file_size (%d bytes), so only an outline or their first part is sent, and they can't be written:\n", maxSize)
+		for _, f := range oversized {
+			Fpf(&b, "    %s: %s\n", f.Path, f.Reason)
+		}
+	}
+	return b.String()
+}
+
+// truncateText cuts txt to at most max bytes, at a line boundary if
+// there is one, and notes how much was cut
+func truncateText(txt string, max int) string {
+	if len(txt) <= max {
+		return txt
+	}
+	cut := txt[:max]
+	if i := strings.LastIndex(cut, "\n"); i > 0 {
+		cut = cut[:i+1]
+	}
+	return cut + Spf("\n[aidda: truncated; showing the first %d of %d bytes]\n", len(cut), len(txt))
+}
+
+// fileView returns the text of fn as it is sent to GPT, and whether
+// that is the whole file.  A file larger than maxSize is sent as an
+// outline of its declarations if it is Go source, or else as its
+// first maxSize bytes.  A binary file is sent as a note.  A maxSize of
+// zero means no limit.
+func fileView(fn string, maxSize int) (view string, full bool, err error) {
+	defer Return(&err)
+	binary, err := isBinary(fn)
+	Ck(err)
+	buf, err := os.ReadFile(fn)
+	Ck(err)
+	if binary {
+		return Spf("[aidda: %s is a binary file of %d bytes, so it is not shown]\n", fn, len(buf)), false, nil
+	}
+	if maxSize <= 0 || len(buf) <= maxSize {
+		return string(buf), true, nil
+	}
+	if strings.HasSuffix(fn, ".go") {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, fn, buf, parser.SkipObjectResolution)
+		if err == nil {
+			view = Spf("[aidda: %s is %d bytes, so only its declarations are shown]\n\n", fn, len(buf)) + outlineFile(fset, f)
+			return truncateText(view, maxSize), false, nil
+		}
+	}
+	return truncateText(string(buf), maxSize), false, nil
+}
+
+// filterSendable removes the files in outFns that GPT can't see in
+// full, because they are binary or larger than maxSize, and returns
+// them in rejected
+func filterSendable(outFns []string, maxSize int) (allowed []string, rejected []rejectedWrite, err error) {
+	defer Return(&err)
+	for _, fn := range outFns {
+		info, err := os.Stat(fn)
+		if os.IsNotExist(err) {
+			allowed = append(allowed, fn)
+			continue
+		}
+		Ck(err)
+		binary, err := isBinary(fn)
+		Ck(err)
+		switch {
+		case binary:
+			rejected = append(rejected, rejectedWrite{Path: fn, Reason: "binary file"})
+		case maxSize > 0 && info.Size() > int64(maxSize):
+			rejected = append(rejected, rejectedWrite{Path: fn, Reason: Spf("larger than max_file_size (%d bytes)", maxSize)})
+		default:
+			allowed = append(allowed, fn)
+		}
+	}
+	return
+}
+
+// sendViews sends the files in inFns, substituting the text in views
+// for the files it has an entry for.  The provider reads the files it
+// is given from disk, so the files with a view are sent instead as
+// messages of their own, in the format the provider uses for files.
+func sendViews(llm Provider, sysmsg string, msgs []core.ChatMsg, inFns []string, outFls []core.FileLang, views map[string]string) (resp string, err error) {
+	defer Return(&err)
+	var fromDisk []string
+	var viewMsgs []core.ChatMsg
+	for _, fn := range inFns {
+		txt, ok := views[fn]
+		if !ok {
+			fromDisk = append(fromDisk, fn)
+			continue
+		}
+		if !strings.HasSuffix(txt, "\n") {
+			txt += "\n"
+		}
+		viewMsgs = append(viewMsgs, core.ChatMsg{Role: "USER", Txt: Spf("File: %s\n```\n%s```\n", fn, txt)})
+	}
+	return send(llm, sysmsg, append(viewMsgs, msgs...), fromDisk, outFls)
+}
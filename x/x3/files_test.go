@@ -0,0 +1,92 @@
+package x3
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanFiles(t *testing.T) {
+	// a multibyte character straddling the sniff boundary is still text
+	edge := strings.Repeat("a", sniffSize-1) + "é"
+	promptFn := filepath.Join(chdirTemp(t, map[string]string{
+		"a.go":       "package a\n",
+		"edge.txt":   edge,
+		"logo.png":   "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR",
+		"latin1.txt": "caf\xe9\n",
+		"big.go":     "package a\n\n" + strings.Repeat("// filler\n", 20) + "func Big() {}\n",
+	}), "prompt")
+	files, skipped, err := scanFiles(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, " ") != "a.go big.go edge.txt" {
+		t.Errorf("unexpected files: %v", files)
+	}
+	if len(skipped) != 2 || skipped[0].Path != "latin1.txt" || skipped[1].Path != "logo.png" {
+		t.Errorf("expected the binaries to be skipped, got %v", skipped)
+	}
+
+	// the prompt file notes what was left out
+	cfg := defaultConfig()
+	cfg.MaxFileSize = 100
+	err = createPromptFile(cfg, promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := readPrompt(promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(p.Out, " ") != "a.go" {
+		t.Errorf("expected oversized files to be left out of Out, got %v", p.Out)
+	}
+	note, _ := p.Attachment(attachSkippedFiles)
+	for _, want := range []string{"logo.png: binary", "big.go: ", "edge.txt: "} {
+		if !strings.Contains(note, want) {
+			t.Errorf("expected %q in %q", want, note)
+		}
+	}
+}
+
+func TestFileView(t *testing.T) {
+	big := "package a\n\n" + strings.Repeat("// filler\n", 20) + "func Big() {}\n"
+	chdirTemp(t, map[string]string{
+		"a.go":    "package a\n",
+		"big.go":  big,
+		"big.txt": strings.Repeat("line\n", 40),
+	})
+	view, full, err := fileView("a.go", 100)
+	if err != nil || !full || view != "package a\n" {
+		t.Errorf("expected a.go in full, got %q %v %v", view, full, err)
+	}
+	view, full, err = fileView("big.go", 100)
+	if err != nil || full || !strings.Contains(view, "func Big()") || strings.Contains(view, "filler") {
+		t.Errorf("expected an outline of big.go, got %q %v %v", view, full, err)
+	}
+	view, full, err = fileView("big.txt", 100)
+	if err != nil || full || !strings.HasPrefix(view, "line\n") || !strings.Contains(view, "first 100 of 200 bytes") {
+		t.Errorf("expected big.txt truncated, got %q %v %v", view, full, err)
+	}
+
+	// GPT is sent the views, and may not write what it can't see
+	cfg := defaultConfig()
+	cfg.MaxFileSize = 100
+	llm := &scriptedProvider{responses: []string{fileResponse("a.go", "go", "package a // new\n")}}
+	p := &Prompt{In: []string{"*.go"}, Out: []string{"*.go"}, Txt: "change a", path: "prompt"}
+	err = writePrompt(p.path, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = getChanges(cfg, llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	req := llm.requests[0]
+	if strings.Contains(req.files["big.go"], "filler") || req.files["a.go"] != "package a\n" {
+		t.Errorf("unexpected files sent: %#v", req.files)
+	}
+	if len(req.outFls) != 1 || req.outFls[0].File != "a.go" {
+		t.Errorf("expected big.go not to be requested, got %v", req.outFls)
+	}
+}
@@ -0,0 +1,138 @@
+package x3
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// gate settings decide what commit does when the quality gate fails
+const (
+	// gateBlock refuses to commit, as aidda.sh does when go vet fails
+	gateBlock = "block"
+	// gatePrompt commits anyway
+	gatePrompt = "prompt"
+	// gateOff doesn't run the gate
+	gateOff = "off"
+)
+
+// attachGate is the name of the prompt attachment that carries the
+// output of a failed quality gate, so GPT can fix it in the next round
+const attachGate = "gate.txt"
+
+// errGateFailed is returned by commit when the gate blocks a commit
+var errGateFailed = errors.New("quality gate failed; see " + attachGate + " in the prompt file, or commit with -F")
+
+// checkGate returns an error if setting is not a known gate setting
+func checkGate(setting string) (err error) {
+	defer Return(&err)
+	switch setting {
+	case gateBlock, gatePrompt, gateOff:
+	default:
+		Assert(false, "unknown gate %q; expected %s, %s, or %s", setting, gateBlock, gatePrompt, gateOff)
+	}
+	return
+}
+
+// setGate sets the gate from a command line flag
+func (cfg *Config) setGate(setting string) (err error) {
+	defer Return(&err)
+	err = checkGate(setting)
+	Ck(err)
+	cfg.Gate = setting
+	cfg.sources["gate"] = sourceFlag
+	return
+}
+
+// gofmtBatch is the most files passed to each run of gofmt, to stay
+// well under the limit on the length of a command line
+const gofmtBatch = 100
+
+// runGate runs gofmt -l, go vet, and the lint command, if any, and
+// returns the output of the ones that failed
+func runGate(cfg *Config) (report string, passed bool, err error) {
+	defer Return(&err)
+	var b strings.Builder
+	timeout, err := cfg.testTimeout()
+	Ck(err)
+	opts := &RunOpts{Timeout: timeout}
+
+	// gofmt the Go files git knows about, so staged responses in
+	// .aidda are skipped
+	fns, err := gitFiles("*.go")
+	Ck(err)
+	var unformatted []string
+	for len(fns) > 0 {
+		batch := fns[:min(gofmtBatch, len(fns))]
+		fns = fns[len(batch):]
+		var existing []string
+		for _, fn := range batch {
+			// git still lists a tracked file that was deleted
+			if _, err := os.Stat(fn); err == nil {
+				existing = append(existing, fn)
+			}
+		}
+		if len(existing) == 0 {
+			continue
+		}
+		res, err := RunContext(context.Background(), "gofmt -l "+quoteArgs(existing...), opts)
+		Ck(err)
+		out := strings.TrimSpace(string(res.Stdout) + string(res.Stderr))
+		if !res.Success() || out != "" {
+			unformatted = append(unformatted, out)
+		}
+	}
+	if len(unformatted) > 0 {
+		Fpf(&b, "gofmt -l lists files that need formatting:\n%s\n\n", strings.Join(unformatted, "\n"))
+	}
+
+	commands := []string{"go vet ./..."}
+	if cfg.Lint != "" {
+		commands = append(commands, cfg.Lint)
+	}
+	for _, command := range commands {
+		res, err := RunContext(context.Background(), command, opts)
+		Ck(err)
+		// some linters, e.g. golint, exit 0 even when they complain
+		out := strings.TrimSpace(string(res.Stdout) + string(res.Stderr))
+		if !res.Success() || out != "" {
+			Fpf(&b, "%s (%s):\n%s\n\n", command, res.Status(), out)
+		}
+	}
+	report = b.String()
+	return report, report == "", nil
+}
+
+// checkGateBeforeCommit runs the quality gate according to the gate
+// setting, and attaches any failures to the prompt file.  It returns
+// errGateFailed if the commit should be blocked.
+func checkGateBeforeCommit(cfg *Config, promptFn string) (err error) {
+	defer Return(&err)
+	if cfg.Gate == gateOff {
+		return
+	}
+	Pf("Running the quality gate\n")
+	report, passed, err := runGate(cfg)
+	Ck(err)
+	if passed {
+		p, err := readPrompt(promptFn)
+		Ck(err)
+		if _, ok := p.Attachment(attachGate); ok {
+			p.RemoveAttachment(attachGate)
+			err = writePrompt(promptFn, p)
+			Ck(err)
+		}
+		return nil
+	}
+	Pl(report)
+	err = setPromptAttachment(promptFn, attachGate, report)
+	Ck(err)
+	if cfg.Gate == gateBlock {
+		return errGateFailed
+	}
+	Pf("Committing despite quality gate failures\n")
+	return
+}
@@ -0,0 +1,95 @@
+package x3
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestGate(t *testing.T) {
+	// go vet must see the temporary module, not any workspace
+	t.Setenv("GOWORK", "off")
+	chdirTemp(t, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.21\n",
+		"a.go":   "package a\n",
+	})
+	gitInit(t)
+	promptFn := ".aidda/prompt"
+	err := createPromptFile(defaultConfig(), promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	llm := &scriptedProvider{}
+
+	// badly formatted code blocks the commit
+	os.WriteFile("a.go", []byte("package a\nfunc  A() {}\n"), 0644)
+	err = commit(cfg, llm, promptFn)
+	if !errors.Is(err, errGateFailed) {
+		t.Fatalf("Expected the gate to block the commit, got: %v", err)
+	}
+	p, err := readPrompt(promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, ok := p.Attachment(attachGate)
+	if !ok || !strings.Contains(report, "a.go") {
+		t.Errorf("Expected the gofmt failure to be attached, got: %q", report)
+	}
+
+	// the lint command is part of the gate, and prompt mode commits
+	// anyway
+	cfg.Gate = gatePrompt
+	cfg.Lint = "echo lint complaint"
+	err = commit(cfg, llm, promptFn)
+	if err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	out, _ := exec.Command("git", "status", "--porcelain").Output()
+	if len(out) != 0 {
+		t.Errorf("Expected the change to be committed, got: %s", out)
+	}
+	p, _ = readPrompt(promptFn)
+	report, _ = p.Attachment(attachGate)
+	if !strings.Contains(report, "lint complaint") {
+		t.Errorf("Expected the lint output to be attached, got: %q", report)
+	}
+
+	// once the gate passes, the attachment is removed
+	cfg.Lint = ""
+	os.WriteFile("a.go", []byte("package a\n\nfunc A() {}\n"), 0644)
+	err = commit(cfg, llm, promptFn)
+	if err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	p, _ = readPrompt(promptFn)
+	if _, ok := p.Attachment(attachGate); ok {
+		t.Errorf("Expected the gate attachment to be removed")
+	}
+}
+
+func TestGateManyFiles(t *testing.T) {
+	t.Setenv("GOWORK", "off")
+	files := map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.21\n",
+		// a path with a space, which would be split in two if it
+		// weren't quoted
+		"my file.go": "package a\nfunc  A() {}\n",
+	}
+	// more files than gofmt is given at once
+	for i := 0; i < gofmtBatch+20; i++ {
+		files[fmt.Sprintf("f%03d.go", i)] = "package a\n"
+	}
+	chdirTemp(t, files)
+	gitInit(t)
+	report, passed, err := runGate(defaultConfig())
+	if err != nil {
+		t.Fatalf("runGate failed: %v", err)
+	}
+	if passed || !strings.Contains(report, "my file.go") || strings.Contains(report, "f000.go") {
+		t.Errorf("Expected only my file.go to need formatting, got: %q", report)
+	}
+}
@@ -11,6 +11,7 @@ require (
 	github.com/stevegt/envi v0.2.0
 	github.com/stevegt/goadapt v0.7.0
 	github.com/stevegt/grokker/v3 v3.0.12
+	golang.org/x/tools v0.30.0
 )
 
 require (
@@ -23,5 +24,7 @@ require (
 	github.com/sashabaranov/go-openai v1.19.1 // indirect
 	github.com/stevegt/semver v0.0.0-20240217000820-5913d1a31c26 // indirect
 	github.com/tiktoken-go/tokenizer v0.1.0 // indirect
-	golang.org/x/sys v0.5.0 // indirect
+	golang.org/x/mod v0.23.0 // indirect
+	golang.org/x/sync v0.11.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 )
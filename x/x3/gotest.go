@@ -0,0 +1,260 @@
+package x3
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// TestEvent is a single event emitted by 'go test -json'; see 'go doc
+// test2json' for the field definitions.
+type TestEvent struct {
+	Time       time.Time
+	Action     string
+	Package    string
+	ImportPath string
+	Test       string
+	Elapsed    float64
+	Output     string
+}
+
+// TestResult is the outcome of a single test or subtest
+type TestResult struct {
+	Package string
+	Name    string
+	// Status is "pass", "fail", "skip", or "" if the test never
+	// finished, e.g. because the test binary panicked or timed out
+	Status  string
+	Elapsed time.Duration
+	Output  []string
+}
+
+// PackageResult is the outcome of all tests in a single package
+type PackageResult struct {
+	Name    string
+	Status  string
+	Elapsed time.Duration
+	Tests   []*TestResult
+	// Output holds package-level output, such as the final
+	// "FAIL" line or a panic that happened outside of any test
+	Output []string
+	tests  map[string]*TestResult
+}
+
+// TestReport is the parsed result of a 'go test -json' run
+type TestReport struct {
+	Packages []*PackageResult
+	// Stray holds lines that are not associated with any test
+	// package, e.g. build errors or non-JSON output
+	Stray []string
+	pkgs  map[string]*PackageResult
+}
+
+// ParseTestJSON parses the output of 'go test -json' into a TestReport
+func ParseTestJSON(r io.Reader) (report *TestReport, err error) {
+	defer Return(&err)
+	report = &TestReport{pkgs: make(map[string]*PackageResult)}
+	scanner := bufio.NewScanner(r)
+	// test output lines can be long
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "{") {
+			// build errors are printed as plain text
+			if strings.TrimSpace(line) != "" {
+				report.Stray = append(report.Stray, line)
+			}
+			continue
+		}
+		var ev TestEvent
+		err = json.Unmarshal([]byte(line), &ev)
+		if err != nil {
+			report.Stray = append(report.Stray, line)
+			err = nil
+			continue
+		}
+		report.add(&ev)
+	}
+	Ck(scanner.Err())
+	return
+}
+
+// add applies a single event to the report
+func (report *TestReport) add(ev *TestEvent) {
+	switch ev.Action {
+	case "build-output":
+		report.Stray = append(report.Stray, strings.TrimRight(ev.Output, "\n"))
+		return
+	case "build-fail":
+		return
+	}
+	if ev.Package == "" {
+		if ev.Output != "" {
+			report.Stray = append(report.Stray, strings.TrimRight(ev.Output, "\n"))
+		}
+		return
+	}
+	pkg := report.pkg(ev.Package)
+	elapsed := time.Duration(ev.Elapsed * float64(time.Second))
+	if ev.Test == "" {
+		switch ev.Action {
+		case "output":
+			pkg.Output = append(pkg.Output, strings.TrimRight(ev.Output, "\n"))
+		case "pass", "fail", "skip":
+			pkg.Status = ev.Action
+			pkg.Elapsed = elapsed
+		}
+		return
+	}
+	test := pkg.test(ev.Test)
+	switch ev.Action {
+	case "output":
+		test.Output = append(test.Output, strings.TrimRight(ev.Output, "\n"))
+	case "pass", "fail", "skip":
+		test.Status = ev.Action
+		test.Elapsed = elapsed
+	}
+}
+
+// pkg returns the PackageResult for name, creating it if needed
+func (report *TestReport) pkg(name string) (pkg *PackageResult) {
+	pkg, ok := report.pkgs[name]
+	if !ok {
+		pkg = &PackageResult{Name: name, tests: make(map[string]*TestResult)}
+		report.pkgs[name] = pkg
+		report.Packages = append(report.Packages, pkg)
+	}
+	return
+}
+
+// test returns the TestResult for name, creating it if needed
+func (pkg *PackageResult) test(name string) (test *TestResult) {
+	test, ok := pkg.tests[name]
+	if !ok {
+		test = &TestResult{Package: pkg.Name, Name: name}
+		pkg.tests[name] = test
+		pkg.Tests = append(pkg.Tests, test)
+	}
+	return
+}
+
+// Counts returns the number of passed, failed, and skipped tests.
+// Tests that never finished are counted as failed.
+func (report *TestReport) Counts() (pass, fail, skip int) {
+	for _, pkg := range report.Packages {
+		for _, test := range pkg.Tests {
+			switch test.Status {
+			case "pass":
+				pass++
+			case "skip":
+				skip++
+			default:
+				fail++
+			}
+		}
+	}
+	return
+}
+
+// Failed returns the tests that failed or never finished, sorted by
+// package and name
+func (report *TestReport) Failed() (failed []*TestResult) {
+	for _, pkg := range report.Packages {
+		for _, test := range pkg.Tests {
+			if test.Status != "pass" && test.Status != "skip" {
+				failed = append(failed, test)
+			}
+		}
+	}
+	sort.SliceStable(failed, func(i, j int) bool {
+		if failed[i].Package != failed[j].Package {
+			return failed[i].Package < failed[j].Package
+		}
+		return failed[i].Name < failed[j].Name
+	})
+	return
+}
+
+// Passed returns true if every package passed and there was no stray
+// output such as build errors
+func (report *TestReport) Passed() bool {
+	if len(report.Stray) > 0 || len(report.Packages) == 0 {
+		return false
+	}
+	for _, pkg := range report.Packages {
+		if pkg.Status == "fail" || pkg.Status == "" {
+			return false
+		}
+	}
+	_, fail, _ := report.Counts()
+	return fail == 0
+}
+
+// Summary returns a compact, failure-focused summary of the report
+// that is suitable for including in a prompt.  Output from passing
+// tests is omitted.
+func (report *TestReport) Summary() string {
+	var b strings.Builder
+	pass, fail, skip := report.Counts()
+	status := "FAIL"
+	if report.Passed() {
+		status = "PASS"
+	}
+	fmt.Fprintf(&b, "Test results: %s (%d passed, %d failed, %d skipped)\n", status, pass, fail, skip)
+	if len(report.Stray) > 0 {
+		b.WriteString("\nBuild output:\n")
+		for _, line := range report.Stray {
+			fmt.Fprintf(&b, "    %s\n", line)
+		}
+	}
+	for _, pkg := range report.Packages {
+		var failed []*TestResult
+		for _, test := range pkg.Tests {
+			if test.Status != "pass" && test.Status != "skip" {
+				failed = append(failed, test)
+			}
+		}
+		if pkg.Status != "fail" && pkg.Status != "" && len(failed) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\nFAIL %s (%s)\n", pkg.Name, pkg.Elapsed)
+		for _, test := range failed {
+			status := test.Status
+			if status == "" {
+				status = "did not finish"
+			}
+			fmt.Fprintf(&b, "--- %s: %s (%s)\n", strings.ToUpper(status), test.Name, test.Elapsed)
+			for _, line := range test.Output {
+				if isTestChatter(line) {
+					continue
+				}
+				fmt.Fprintf(&b, "%s\n", line)
+			}
+		}
+		if len(failed) == 0 {
+			// no failing tests, so the failure happened at the
+			// package level, e.g. a panic in TestMain or a timeout
+			for _, line := range pkg.Output {
+				fmt.Fprintf(&b, "%s\n", line)
+			}
+		}
+	}
+	return b.String()
+}
+
+// isTestChatter returns true if line is a test framework status line
+// that carries no information about the failure
+func isTestChatter(line string) bool {
+	for _, prefix := range []string{"=== RUN", "=== PAUSE", "=== CONT", "=== NAME", "--- FAIL:", "--- PASS:", "--- SKIP:"} {
+		if strings.HasPrefix(strings.TrimSpace(line), prefix) {
+			return true
+		}
+	}
+	return false
+}
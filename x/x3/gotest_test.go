@@ -0,0 +1,79 @@
+package x3
+
+import (
+	"strings"
+	"testing"
+)
+
+// testJSON is a trimmed-down capture of 'go test -json' output with
+// one passing, one failing, and one skipped test
+var testJSON = strings.Join([]string{
+	`{"Action":"start","Package":"example.com/foo"}`,
+	`{"Action":"run","Package":"example.com/foo","Test":"TestPass"}`,
+	`{"Action":"output","Package":"example.com/foo","Test":"TestPass","Output":"=== RUN   TestPass\n"}`,
+	`{"Action":"output","Package":"example.com/foo","Test":"TestPass","Output":"chatty passing output\n"}`,
+	`{"Action":"pass","Package":"example.com/foo","Test":"TestPass","Elapsed":0.01}`,
+	`{"Action":"run","Package":"example.com/foo","Test":"TestFail"}`,
+	`{"Action":"output","Package":"example.com/foo","Test":"TestFail","Output":"=== RUN   TestFail\n"}`,
+	`{"Action":"output","Package":"example.com/foo","Test":"TestFail","Output":"    foo_test.go:12: expected 1, got 2\n"}`,
+	`{"Action":"output","Package":"example.com/foo","Test":"TestFail","Output":"--- FAIL: TestFail (0.00s)\n"}`,
+	`{"Action":"fail","Package":"example.com/foo","Test":"TestFail","Elapsed":0}`,
+	`{"Action":"run","Package":"example.com/foo","Test":"TestSkip"}`,
+	`{"Action":"skip","Package":"example.com/foo","Test":"TestSkip","Elapsed":0}`,
+	`{"Action":"output","Package":"example.com/foo","Output":"FAIL\n"}`,
+	`{"Action":"fail","Package":"example.com/foo","Elapsed":0.02}`,
+}, "\n")
+
+func TestParseTestJSON(t *testing.T) {
+	report, err := ParseTestJSON(strings.NewReader(testJSON))
+	if err != nil {
+		t.Fatalf("ParseTestJSON failed: %v", err)
+	}
+	if len(report.Packages) != 1 {
+		t.Fatalf("Expected 1 package, got: %d", len(report.Packages))
+	}
+	pass, fail, skip := report.Counts()
+	if pass != 1 || fail != 1 || skip != 1 {
+		t.Errorf("Expected 1/1/1 pass/fail/skip, got: %d/%d/%d", pass, fail, skip)
+	}
+	if report.Passed() {
+		t.Errorf("Expected report to fail")
+	}
+	failed := report.Failed()
+	if len(failed) != 1 || failed[0].Name != "TestFail" {
+		t.Fatalf("Expected TestFail to be the only failure, got: %v", failed)
+	}
+}
+
+func TestTestReportSummary(t *testing.T) {
+	report, err := ParseTestJSON(strings.NewReader(testJSON))
+	if err != nil {
+		t.Fatalf("ParseTestJSON failed: %v", err)
+	}
+	summary := report.Summary()
+	// the summary should include the failure message...
+	if !strings.Contains(summary, "foo_test.go:12: expected 1, got 2") {
+		t.Errorf("Expected failure message in summary, got: %s", summary)
+	}
+	// ...but not chatter from passing tests
+	if strings.Contains(summary, "chatty passing output") {
+		t.Errorf("Expected passing test output to be omitted, got: %s", summary)
+	}
+}
+
+func TestParseTestJSONBuildError(t *testing.T) {
+	// build errors are printed as plain text rather than JSON
+	out := "# example.com/foo\n./foo.go:3:1: syntax error\n" +
+		`{"Action":"output","Package":"example.com/foo","Output":"FAIL\texample.com/foo [build failed]\n"}` + "\n" +
+		`{"Action":"fail","Package":"example.com/foo","Elapsed":0}` + "\n"
+	report, err := ParseTestJSON(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("ParseTestJSON failed: %v", err)
+	}
+	if report.Passed() {
+		t.Errorf("Expected report to fail")
+	}
+	if !strings.Contains(report.Summary(), "syntax error") {
+		t.Errorf("Expected build error in summary, got: %s", report.Summary())
+	}
+}
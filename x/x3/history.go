@@ -0,0 +1,203 @@
+package x3
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// every prompt round is recorded in historyDir
+const historyDir = ".aidda/history"
+
+// historyRecord is a single prompt round
+type historyRecord struct {
+	ID    string
+	Time  time.Time
+	Model string
+	Mode  string
+	// Iteration is the loop iteration that sent the round, or 0 if
+	// it wasn't sent by the loop subcommand
+	Iteration int
+	// InPatterns and OutPatterns are the prompt headers, and In and
+	// Out are the files they expanded to
+	InPatterns  []string
+	OutPatterns []string
+	In          []string
+	Out         []string
+	Sysmsg      string
+	Prompt      string
+	Attachments []Attachment
+	TokenCounts []historyTokenCount
+	// Response is the response that was staged, after any
+	// Corrections
+	Response    string
+	Corrections []historyCorrection
+	Elapsed     time.Duration
+	// Applied is set when the response is applied to the working
+	// tree, and Commit is the commit that then included it
+	Applied bool
+	Commit  string
+}
+
+// historyCorrection is a response whose Go files had errors, which
+// were sent back to GPT to fix
+type historyCorrection struct {
+	Response string
+	Errors   string
+}
+
+// historyTokenCount is the token count of one part of a query
+type historyTokenCount struct {
+	Name  string
+	Count int
+}
+
+// newHistoryID returns a new, sortable record ID
+func newHistoryID() string {
+	return time.Now().Format("20060102-150405.000000")
+}
+
+// historyFn returns the path of the record with the given ID
+func historyFn(id string) string {
+	return filepath.Join(historyDir, id+".json")
+}
+
+// saveHistory writes a record
+func saveHistory(rec *historyRecord) (err error) {
+	defer Return(&err)
+	err = os.MkdirAll(historyDir, 0755)
+	Ck(err)
+	// history is local to the user, so keep it out of commits
+	err = os.WriteFile(filepath.Join(historyDir, ".gitignore"), []byte("*\n"), 0644)
+	Ck(err)
+	buf, err := json.MarshalIndent(rec, "", "    ")
+	Ck(err)
+	err = os.WriteFile(historyFn(rec.ID), buf, 0644)
+	Ck(err)
+	return
+}
+
+// loadHistory reads the record with the given ID
+func loadHistory(id string) (rec *historyRecord, err error) {
+	defer Return(&err)
+	buf, err := os.ReadFile(historyFn(id))
+	Ck(err)
+	rec = &historyRecord{}
+	err = json.Unmarshal(buf, rec)
+	Ck(err)
+	return
+}
+
+// listHistory returns all records, oldest first
+func listHistory() (recs []*historyRecord, err error) {
+	defer Return(&err)
+	fns, err := filepath.Glob(filepath.Join(historyDir, "*.json"))
+	Ck(err)
+	sort.Strings(fns)
+	for _, fn := range fns {
+		id := strings.TrimSuffix(filepath.Base(fn), ".json")
+		rec, err := loadHistory(id)
+		Ck(err)
+		recs = append(recs, rec)
+	}
+	return
+}
+
+// markHistoryApplied records that the response of the given round
+// was applied to the working tree
+func markHistoryApplied(id string) (err error) {
+	defer Return(&err)
+	if id == "" {
+		return
+	}
+	rec, err := loadHistory(id)
+	Ck(err)
+	rec.Applied = true
+	err = saveHistory(rec)
+	Ck(err)
+	return
+}
+
+// uncommittedRounds returns the IDs of the applied rounds that aren't
+// yet part of a commit
+func uncommittedRounds() (ids []string, err error) {
+	defer Return(&err)
+	recs, err := listHistory()
+	Ck(err)
+	for _, rec := range recs {
+		if rec.Applied && rec.Commit == "" {
+			ids = append(ids, rec.ID)
+		}
+	}
+	return
+}
+
+// markHistoryCommitted records hash as the commit of every applied
+// round that isn't yet part of a commit
+func markHistoryCommitted(hash string) (err error) {
+	defer Return(&err)
+	recs, err := listHistory()
+	Ck(err)
+	for _, rec := range recs {
+		if rec.Applied && rec.Commit == "" {
+			rec.Commit = hash
+			err = saveHistory(rec)
+			Ck(err)
+		}
+	}
+	return
+}
+
+// showHistoryLog prints a summary of each round, newest first
+func showHistoryLog() (err error) {
+	defer Return(&err)
+	recs, err := listHistory()
+	Ck(err)
+	if len(recs) == 0 {
+		Pf("No history\n")
+		return
+	}
+	for i := len(recs) - 1; i >= 0; i-- {
+		rec := recs[i]
+		total := 0
+		for _, tc := range rec.TokenCounts {
+			total += tc.Count
+		}
+		status := "not applied"
+		if rec.Commit != "" {
+			status = "commit " + rec.Commit[:min(len(rec.Commit), 12)]
+		} else if rec.Applied {
+			status = "applied, not committed"
+		}
+		prompt, _, _ := strings.Cut(rec.Prompt, "\n")
+		Pf("%s  %s\n", rec.ID, rec.Time.Format(time.RFC1123))
+		Pf("    mode %s, %d in, %d out, %d tokens, %s, %s\n",
+			rec.Mode, len(rec.In), len(rec.Out), total, rec.Elapsed.Round(time.Millisecond), status)
+		Pf("    %s\n", prompt)
+	}
+	return
+}
+
+// replayHistory re-sends the prompt of the given round against the
+// current tree
+func replayHistory(cfg *Config, llm Provider, id string) (err error) {
+	defer Return(&err)
+	rec, err := loadHistory(id)
+	Ck(err)
+	p := &Prompt{
+		In:          rec.InPatterns,
+		Out:         rec.OutPatterns,
+		Mode:        rec.Mode,
+		Txt:         rec.Prompt,
+		Attachments: rec.Attachments,
+	}
+	Pf("Replaying %s\n", id)
+	_, err = getChanges(cfg, llm, p)
+	Ck(err)
+	return
+}
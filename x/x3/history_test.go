@@ -0,0 +1,60 @@
+package x3
+
+import (
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	resp := fileResponse("a.go", "go", "package a // new\n")
+	llm := &scriptedProvider{responses: []string{resp, resp}}
+	p := &Prompt{In: []string{"*.go"}, Out: []string{"*.go"}, Txt: "change a"}
+	_, err := getChanges(defaultConfig(), llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	recs, err := listHistory()
+	if err != nil {
+		t.Fatalf("listHistory failed: %v", err)
+	}
+	if len(recs) != 1 {
+		t.Fatalf("Expected 1 record, got: %d", len(recs))
+	}
+	rec := recs[0]
+	if rec.Prompt != "change a" || rec.Response != resp || len(rec.TokenCounts) == 0 {
+		t.Errorf("Unexpected record: %#v", rec)
+	}
+	if rec.Applied || rec.Commit != "" {
+		t.Errorf("Expected record to be neither applied nor committed")
+	}
+
+	// applying and committing the change is reflected in the record
+	_, _, err = applyPending(false)
+	if err != nil {
+		t.Fatalf("applyPending failed: %v", err)
+	}
+	err = markHistoryCommitted("0123456789abcdef")
+	if err != nil {
+		t.Fatalf("markHistoryCommitted failed: %v", err)
+	}
+	rec, err = loadHistory(rec.ID)
+	if err != nil {
+		t.Fatalf("loadHistory failed: %v", err)
+	}
+	if !rec.Applied || rec.Commit != "0123456789abcdef" {
+		t.Errorf("Expected record to be applied and committed, got: %v %q", rec.Applied, rec.Commit)
+	}
+
+	// replay sends the same prompt again
+	err = replayHistory(defaultConfig(), llm, rec.ID)
+	if err != nil {
+		t.Fatalf("replayHistory failed: %v", err)
+	}
+	if len(llm.requests) != 2 || llm.requests[1].msgs[0].Txt != "change a" {
+		t.Errorf("Expected replay to re-send the prompt, got: %#v", llm.requests)
+	}
+	err = showHistoryLog()
+	if err != nil {
+		t.Fatalf("showHistoryLog failed: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package x3
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+
+	gitignore "github.com/sabhiram/go-gitignore"
+	. "github.com/stevegt/goadapt"
+)
+
+// aiddaIgnoreFn is aidda's own ignore file, applied on top of any
+// .gitignore files
+const aiddaIgnoreFn = ".aidda/ignore"
+
+// ignoreRule is one pattern of an ignore file
+type ignoreRule struct {
+	Fn     string
+	LineNo int
+	Line   string
+	// Negate is set for a '!' pattern, which re-includes what an
+	// earlier pattern ignored
+	Negate bool
+	gi     *gitignore.GitIgnore
+}
+
+// String describes where the rule came from
+func (rule *ignoreRule) String() string {
+	return Spf("'%s' at %s:%d", rule.Line, rule.Fn, rule.LineNo)
+}
+
+// ignoreFile holds the rules of an ignore file, which apply to the
+// paths under dir
+type ignoreFile struct {
+	dir   string
+	rules []ignoreRule
+}
+
+// readIgnoreFile reads the ignore file fn, whose patterns are relative
+// to dir.  It returns nil if fn doesn't exist.
+func readIgnoreFile(fn, dir string) (f *ignoreFile, err error) {
+	defer Return(&err)
+	file, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	Ck(err)
+	defer file.Close()
+	f = &ignoreFile{dir: dir}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// compile each pattern on its own, so we know which one
+		// matched last
+		pat := line
+		negate := strings.HasPrefix(pat, "!")
+		if negate {
+			pat = pat[1:]
+		}
+		f.rules = append(f.rules, ignoreRule{
+			Fn:     fn,
+			LineNo: n,
+			Line:   line,
+			Negate: negate,
+			gi:     gitignore.CompileIgnoreLines(pat),
+		})
+	}
+	Ck(scanner.Err())
+	return
+}
+
+// match returns the last rule in f that matches fn, a slash-separated
+// path relative to the top of the tree, or nil if none does
+func (f *ignoreFile) match(fn string) (rule *ignoreRule) {
+	if f == nil {
+		return nil
+	}
+	if f.dir != "." {
+		if !strings.HasPrefix(fn, f.dir+"/") {
+			return nil
+		}
+		fn = strings.TrimPrefix(fn, f.dir+"/")
+	}
+	for i := range f.rules {
+		if f.rules[i].gi.MatchesPath(fn) {
+			rule = &f.rules[i]
+		}
+	}
+	return
+}
+
+// ignoreRules decides which paths are ignored.  The .gitignore files
+// in the tree, if they are used, apply first, with deeper ones taking
+// precedence, and then .aidda/ignore.  The last rule that matches
+// decides, as in git.
+type ignoreRules struct {
+	gitignores bool
+	aidda      *ignoreFile
+	// dirs caches the .gitignore file of each directory
+	dirs map[string]*ignoreFile
+}
+
+// newIgnoreRules reads .aidda/ignore, and the .gitignore files as
+// they are needed if gitignores is set
+func newIgnoreRules(gitignores bool) (rules *ignoreRules, err error) {
+	defer Return(&err)
+	rules = &ignoreRules{gitignores: gitignores, dirs: make(map[string]*ignoreFile)}
+	rules.aidda, err = readIgnoreFile(aiddaIgnoreFn, ".")
+	Ck(err)
+	return
+}
+
+// gitignore returns the .gitignore file in dir, or nil if there is none
+func (rules *ignoreRules) gitignore(dir string) (f *ignoreFile, err error) {
+	defer Return(&err)
+	f, ok := rules.dirs[dir]
+	if ok {
+		return
+	}
+	f, err = readIgnoreFile(path.Join(dir, ".gitignore"), dir)
+	Ck(err)
+	rules.dirs[dir] = f
+	return
+}
+
+// check returns the rule that decides whether fn is ignored, ignoring
+// the directories above it, or nil if no rule matches
+func (rules *ignoreRules) check(fn string, isDir bool) (rule *ignoreRule, err error) {
+	defer Return(&err)
+	pat := fn
+	if isDir {
+		// so patterns with a trailing slash match
+		pat += "/"
+	}
+	if rules.gitignores {
+		dir := "."
+		for _, part := range strings.Split(fn, "/") {
+			f, err := rules.gitignore(dir)
+			Ck(err)
+			if m := f.match(pat); m != nil {
+				rule = m
+			}
+			dir = path.Join(dir, part)
+		}
+	}
+	if m := rules.aidda.match(pat); m != nil {
+		rule = m
+	}
+	return
+}
+
+// ignored returns the rule that decides whether fn is ignored, or nil
+// if no rule matches.  If a directory above fn is ignored, so is fn,
+// whatever the rules say about fn itself, and that directory is
+// returned in dir.
+func (rules *ignoreRules) ignored(fn string, isDir bool) (rule *ignoreRule, dir string, err error) {
+	defer Return(&err)
+	parts := strings.Split(fn, "/")
+	for i := 1; i < len(parts); i++ {
+		dir = strings.Join(parts[:i], "/")
+		rule, err = rules.check(dir, true)
+		Ck(err)
+		if rule != nil && !rule.Negate {
+			return
+		}
+	}
+	rule, err = rules.check(fn, isDir)
+	Ck(err)
+	return rule, "", nil
+}
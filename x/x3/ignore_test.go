@@ -0,0 +1,98 @@
+package x3
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"a.go":                     "package a\n",
+		"foo.github.go":            "package a\n",
+		".github/workflows/ci.yml": "on: push\n",
+		"debug.log":                "log\n",
+		"keep.log":                 "log\n",
+		"build/out.txt":            "out\n",
+		"build/keep.txt":           "keep\n",
+		"sub/b.go":                 "package sub\n",
+		"sub/gen.go":               "package sub\n",
+		"sub/deep/c.go":            "package deep\n",
+		"sub/deep/gen.go":          "package deep\n",
+		"notes.md":                 "notes\n",
+		".gitignore":               "*.log\nbuild/\n",
+		"sub/.gitignore":           "gen.go\n",
+		"sub/deep/.gitignore":      "!gen.go\n",
+		// .aidda/ignore applies on top, and can re-include
+		aiddaIgnoreFn: ".git\nnotes.md\n!keep.log\n!build/keep.txt\n",
+	})
+	files, err := getFiles(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ".github/workflows/ci.yml .gitignore a.go foo.github.go keep.log sub/.gitignore sub/b.go sub/deep/.gitignore sub/deep/c.go sub/deep/gen.go"
+	if got := strings.Join(files, " "); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+
+	cfg := defaultConfig()
+	cases := []struct {
+		fn       string
+		included bool
+		reason   string
+	}{
+		{"foo.github.go", true, "not ignored"},
+		{"debug.log", false, "matches '*.log' at .gitignore:1"},
+		{"keep.log", true, "re-included by '!keep.log' at .aidda/ignore:3"},
+		{"build/keep.txt", false, "in build, which matches 'build/' at .gitignore:2"},
+		{"sub/gen.go", false, "matches 'gen.go' at sub/.gitignore:1"},
+		{"sub/deep/gen.go", true, "re-included by '!gen.go' at sub/deep/.gitignore:1"},
+		{"notes.md", false, "matches 'notes.md' at .aidda/ignore:2"},
+		{".aidda/ignore", false, "inside .aidda"},
+		{"missing.go", false, "does not exist"},
+	}
+	for _, c := range cases {
+		included, reason, err := explainFile(cfg, c.fn)
+		if err != nil {
+			t.Fatalf("%s: %v", c.fn, err)
+		}
+		if included != c.included || reason != c.reason {
+			t.Errorf("%s: expected %v %q, got %v %q", c.fn, c.included, c.reason, included, reason)
+		}
+	}
+}
+
+func TestDiscoverGit(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"a.go":       "package a\n",
+		"tracked.go": "package a\n",
+		".gitignore": "*.log\ntracked.go\n",
+		"debug.log":  "log\n",
+	})
+	gitInit(t)
+	_, err := runOk("git add -f tracked.go", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile("new.go", []byte("package a\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.Discover = discoverGit
+	files, err := getFiles(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// git lists tracked files even if they match .gitignore
+	if got := strings.Join(files, " "); got != ".gitignore a.go new.go tracked.go" {
+		t.Errorf("unexpected files: %s", got)
+	}
+	included, reason, err := explainFile(cfg, "debug.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if included || reason != "ignored by git, at .gitignore:1:*.log" {
+		t.Errorf("unexpected explanation of debug.log: %v %q", included, reason)
+	}
+}
@@ -0,0 +1,147 @@
+package x3
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/core"
+)
+
+// names of additional attachments maintained by the loop subcommand
+const attachRecommendations = "recommendations.md"
+
+// sysmsgRecommend is the system message for the final pass of the
+// loop subcommand
+const sysmsgRecommend = "Recommend additional tests to improve coverage and robustness of code."
+
+// runLoop runs tests, sends failures to GPT, and applies the returned
+// files to the working tree, repeating until the tests pass or the
+// iteration or time budget is exhausted.  This is the loop from
+// aidda.sh, built on commit, runTest, and getChanges.  As in
+// aidda.sh, tests mode keeps going after the tests pass.
+//
+// The budgets are set by loop_iterations and loop_timeout in the
+// config.
+func runLoop(cfg *Config, llm Provider, promptFn string) (err error) {
+	defer Return(&err)
+	maxIterations := cfg.LoopIterations
+	timeout, err := cfg.loopTimeout()
+	Ck(err)
+	p, err := readPrompt(promptFn)
+	Ck(err)
+	mode, err := cfg.promptMode(p)
+	Ck(err)
+	Assert(mode != ModeAdvice, "the loop subcommand does not support advice mode")
+
+	start := time.Now()
+	for i := 1; ; i++ {
+		if i > maxIterations {
+			Pf("aidda: loop: giving up after %d iterations\n", maxIterations)
+			break
+		}
+		if time.Since(start) > timeout {
+			Pf("aidda: loop: giving up after %s\n", timeout)
+			break
+		}
+		Pf("aidda: loop: iteration %d\n", i)
+
+		// commit the previous iteration's changes, if any, so each
+		// round can be reviewed and reverted separately
+		err = loopCommit(cfg, llm, promptFn)
+		Ck(err)
+
+		// a failing or hung test run is the normal case here; only a
+		// test command that can't run stops the loop
+		report, res, err := runTest(cfg, promptFn)
+		Ck(err)
+		if res.TimedOut {
+			Pf("aidda: loop: tests %s\n", res.Status())
+		}
+		// in tests mode, keep generating tests until we run out
+		// of budget
+		if testsPassed(report, res) && mode != ModeTests {
+			Pf("aidda: loop: tests pass after %d iterations\n", i)
+			// as in aidda.sh, only code mode goes on to ask for
+			// more tests
+			if mode == ModeCode {
+				err = recommendTests(cfg, llm, promptFn)
+				Ck(err)
+			}
+			break
+		}
+
+		// re-read the prompt to pick up the new test results
+		p, err := readPrompt(promptFn)
+		Ck(err)
+		rec, err := getChanges(cfg, llm, p)
+		if errors.Is(err, errEscalated) {
+			// as in aidda.sh, a TESTERROR or CODEERROR stops the
+			// loop
+			Pf("aidda: loop: stopping; %v\n", err)
+			break
+		}
+		Ck(err)
+		// the iteration ends up in the commit's provenance trailers
+		rec.Iteration = i
+		err = saveHistory(rec)
+		Ck(err)
+		manifest, err := readPending()
+		Ck(err)
+		if manifest == nil {
+			continue
+		}
+		_, conflicts, err := applyPending(false)
+		Ck(err)
+		if len(conflicts) > 0 {
+			Pf("aidda: loop: files changed while waiting for GPT: %s\n", strings.Join(conflicts, ", "))
+			Pf("aidda: loop: stopping; run 'show', 'apply', or 'reject'\n")
+			break
+		}
+		err = attachLastDiff(promptFn)
+		Ck(err)
+	}
+
+	err = loopCommit(cfg, llm, promptFn)
+	Ck(err)
+	return
+}
+
+// loopCommit commits the changes made so far.  A failed quality gate
+// doesn't stop the loop:  the failures are attached to the prompt, so
+// the next round asks GPT to fix them.
+func loopCommit(cfg *Config, llm Provider, promptFn string) (err error) {
+	err = commit(cfg, llm, promptFn)
+	if errors.Is(err, errGateFailed) {
+		Pf("aidda: loop: not committing until the quality gate passes\n")
+		return nil
+	}
+	return
+}
+
+// recommendTests asks GPT to recommend additional tests and attaches
+// the recommendations to the prompt file
+func recommendTests(cfg *Config, llm Provider, promptFn string) (err error) {
+	defer Return(&err)
+	p, err := readPrompt(promptFn)
+	Ck(err)
+	inFns, _, err := expandPromptFiles(cfg, p)
+	Ck(err)
+	// secrets are masked in everything that is sent
+	red, err := newRedactor(cfg)
+	Ck(err)
+	results, _ := p.Attachment(attachTestResults)
+	msgs := []core.ChatMsg{
+		core.ChatMsg{Role: "USER", Txt: red.redact(attachTestResults, results)},
+	}
+	_, views, err := red.redactFiles(inFns, cfg.MaxFileSize)
+	Ck(err)
+	red.report()
+	resp, _, err := sendRedacted(llm, red, sysmsgRecommend, msgs, inFns, nil, views)
+	Ck(err)
+	Pl(resp)
+	err = setPromptAttachment(promptFn, attachRecommendations, resp)
+	Ck(err)
+	return
+}
@@ -0,0 +1,126 @@
+package x3
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoopRecommend(t *testing.T) {
+	// go test and go vet must see the temporary module, not any
+	// workspace
+	t.Setenv("GOWORK", "off")
+	chdirTemp(t, map[string]string{
+		"go.mod":    "module example.com/m\n\ngo 1.21\n",
+		"a.go":      "package a\n\nfunc A() int { return 1 }\n",
+		"a_test.go": "package a\n\nimport \"testing\"\n\nfunc TestA(t *testing.T) {\n\tif A() != 1 {\n\t\tt.Fail()\n\t}\n}\n",
+	})
+	gitInit(t)
+	cfg := defaultConfig()
+	promptFn := ".aidda/prompt"
+	err := createPromptFile(cfg, promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tests pass, and custom mode stops without asking for more tests
+	llm := &scriptedProvider{}
+	err = runLoop(cfg, llm, promptFn)
+	if err != nil {
+		t.Fatalf("runLoop failed: %v", err)
+	}
+	if len(llm.requests) != 0 {
+		t.Errorf("Expected no requests in custom mode, got: %d", len(llm.requests))
+	}
+
+	// code mode asks for more tests
+	cfg.Mode = ModeCode
+	llm = &scriptedProvider{responses: []string{"Test A with more values."}}
+	err = runLoop(cfg, llm, promptFn)
+	if err != nil {
+		t.Fatalf("runLoop failed: %v", err)
+	}
+	if len(llm.requests) != 1 || llm.requests[0].sysmsg != sysmsgRecommend {
+		t.Fatalf("Expected a request for recommendations, got: %#v", llm.requests)
+	}
+	p, err := readPrompt(promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := p.Attachment(attachRecommendations); rec != "Test A with more values." {
+		t.Errorf("Expected the recommendations to be attached, got: %q", rec)
+	}
+}
+
+func TestLoopGate(t *testing.T) {
+	t.Setenv("GOWORK", "off")
+	chdirTemp(t, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.21\n",
+		"a.go":   "package a\n",
+	})
+	gitInit(t)
+	cfg := defaultConfig()
+	promptFn := ".aidda/prompt"
+	err := createPromptFile(cfg, promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the quality gate fails before and after the tests pass, and
+	// neither stops the loop
+	err = os.WriteFile("a.go", []byte("package a\nfunc  A() {}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runLoop(cfg, &scriptedProvider{}, promptFn)
+	if err != nil {
+		t.Fatalf("runLoop failed: %v", err)
+	}
+	p, err := readPrompt(promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Attachment(attachGate); !ok {
+		t.Errorf("Expected the gate failures to be attached")
+	}
+}
+
+func TestRecommendRedacted(t *testing.T) {
+	fileSecret := "AKIA" + strings.Repeat("F", 16)
+	resultSecret := "AKIA" + strings.Repeat("R", 16)
+	chdirTemp(t, map[string]string{
+		"a.go": "package a\n\n// key " + fileSecret + "\n",
+	})
+	cfg := defaultConfig()
+	promptFn := ".aidda/prompt"
+	p := &Prompt{In: []string{"a.go"}, Out: []string{"a.go"}, Txt: "prompt"}
+	p.SetAttachment(attachTestResults, "--- FAIL: TestA: got "+resultSecret+"\n")
+	err := writePrompt(promptFn, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	llm := &scriptedProvider{responses: []string{"Test A with more values."}}
+	err = recommendTests(cfg, llm, promptFn)
+	if err != nil {
+		t.Fatalf("recommendTests failed: %v", err)
+	}
+	if len(llm.requests) != 1 {
+		t.Fatalf("Expected one request, got: %d", len(llm.requests))
+	}
+	req := llm.requests[0]
+	for _, secret := range []string{fileSecret, resultSecret} {
+		for _, msg := range req.msgs {
+			if strings.Contains(msg.Txt, secret) {
+				t.Errorf("Expected %s to be masked in the request, got: %q", secret, msg.Txt)
+			}
+		}
+		for fn, txt := range req.files {
+			if strings.Contains(txt, secret) {
+				t.Errorf("Expected %s to be masked in %s, got: %q", secret, fn, txt)
+			}
+		}
+	}
+	if !strings.Contains(req.files["a.go"], placeholder(fileSecret)) {
+		t.Errorf("Expected a.go to be sent masked, got: %q", req.files["a.go"])
+	}
+}
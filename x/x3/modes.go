@@ -0,0 +1,119 @@
+package x3
+
+import (
+	"path/filepath"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// modes select the system message sent to GPT and which files GPT
+// may write; they are ported from aidda.sh
+const (
+	// ModeCode writes code to make the tests pass
+	ModeCode = "code"
+	// ModeTests appends tests and may only write test files
+	ModeTests = "tests"
+	// ModeAdvice answers the prompt in .aidda/advice.md without
+	// touching any source files
+	ModeAdvice = "advice"
+	// ModeCustom uses the sysmsg from the config
+	ModeCustom = "custom"
+)
+
+// adviceFn is where advice mode writes its response
+const adviceFn = ".aidda/advice.md"
+
+var sysmsgCode = `You are an expert Go programmer.  Write, add, or fix the
+target code in [%s] to make the tests pass.  In case of conflict
+between tests and target code, consider the tests to be correct.
+Create any missing types, methods, or fields referenced by the tests.
+I am giving you all relevant files. Do not mock the results.  Write
+complete, production-quality code.  Do not write stubs.  Do not omit
+code -- provide the complete file each time.  Do not enclose backticks
+in string literals -- you can't escape backticks in Go, so you'll need
+to build string literals with embedded backticks by using string
+concatenation. Include comments and follow the Go documentation
+conventions.  If you are unable to follow these instructions, say
+TESTERROR on a line by itself and suggest a fix.`
+
+var sysmsgTests = `You are an expert Go programmer.  Append tests to
+[%s] to make the code more robust.  Do not alter or insert before
+existing tests.  Do not inline multiline test data in Go files -- put
+test data in the given output data files.  Do not enclose backticks in
+string literals -- you can't escape backticks in Go, so you'll need to
+build string literals with embedded backticks by using string
+concatenation. If you see an error in the code or need me to do
+anything, say CODEERROR on a line by itself and suggest a fix.`
+
+var sysmsgAdvice = `You are an expert Go programmer.  Answer the
+question or provide the advice requested, referring to the given
+files as needed.  Do not rewrite complete files; show only the
+relevant code fragments.`
+
+// checkMode returns an error if mode is not a known mode
+func checkMode(mode string) (err error) {
+	defer Return(&err)
+	switch mode {
+	case ModeCode, ModeTests, ModeAdvice, ModeCustom:
+	default:
+		Assert(false, "unknown mode %q; expected one of %s, %s, %s, or %s", mode, ModeCode, ModeTests, ModeAdvice, ModeCustom)
+	}
+	return
+}
+
+// promptMode returns the mode to use for p.  A -m flag wins over the
+// prompt's Mode header, which wins over the mode setting in the
+// config.
+func (cfg *Config) promptMode(p *Prompt) (mode string, err error) {
+	defer Return(&err)
+	mode = cfg.Mode
+	if p.Mode != "" && cfg.sources["mode"] != sourceFlag {
+		mode = p.Mode
+	}
+	err = checkMode(mode)
+	Ck(err)
+	return
+}
+
+// modeSysmsg returns the system message for mode
+func modeSysmsg(cfg *Config, mode string, outFns []string) string {
+	switch mode {
+	case ModeCode:
+		return Spf(sysmsgCode, strings.Join(outFns, " "))
+	case ModeTests:
+		return Spf(sysmsgTests, strings.Join(outFns, " "))
+	case ModeAdvice:
+		return sysmsgAdvice
+	}
+	return cfg.Sysmsg
+}
+
+// isTestFile returns true if fn is a Go test file or test data
+func isTestFile(fn string) bool {
+	if strings.HasSuffix(fn, "_test.go") {
+		return true
+	}
+	for _, dir := range strings.Split(filepath.ToSlash(filepath.Dir(fn)), "/") {
+		if dir == "testdata" {
+			return true
+		}
+	}
+	return false
+}
+
+// modeOutFns returns the Out files that mode allows GPT to write,
+// and the ones it refuses
+func modeOutFns(mode string, outFns []string) (allowed, refused []string) {
+	for _, fn := range outFns {
+		switch {
+		case mode == ModeAdvice:
+			refused = append(refused, fn)
+		case mode == ModeTests && !isTestFile(fn):
+			refused = append(refused, fn)
+		default:
+			allowed = append(allowed, fn)
+		}
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package x3
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestModeOutFns(t *testing.T) {
+	outFns := []string{"foo.go", "foo_test.go", "testdata/input.md"}
+	allowed, refused := modeOutFns(ModeTests, outFns)
+	if !reflect.DeepEqual(allowed, []string{"foo_test.go", "testdata/input.md"}) {
+		t.Errorf("Unexpected allowed files in tests mode: %v", allowed)
+	}
+	if !reflect.DeepEqual(refused, []string{"foo.go"}) {
+		t.Errorf("Unexpected refused files in tests mode: %v", refused)
+	}
+	allowed, _ = modeOutFns(ModeAdvice, outFns)
+	if len(allowed) != 0 {
+		t.Errorf("Expected advice mode to refuse all files, got: %v", allowed)
+	}
+	allowed, _ = modeOutFns(ModeCode, outFns)
+	if len(allowed) != 3 {
+		t.Errorf("Expected code mode to allow all files, got: %v", allowed)
+	}
+}
+
+func TestPromptMode(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.sources = map[string]string{}
+	p := &Prompt{Mode: ModeTests}
+	// the Mode header wins over the config...
+	mode, err := cfg.promptMode(p)
+	if err != nil || mode != ModeTests {
+		t.Errorf("Expected tests mode from header, got: %q %v", mode, err)
+	}
+	// ...but a flag wins over the Mode header
+	err = cfg.setMode(ModeCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode, err = cfg.promptMode(p)
+	if err != nil || mode != ModeCode {
+		t.Errorf("Expected code mode from flag, got: %q %v", mode, err)
+	}
+	p.Mode = "bogus"
+	cfg.sources["mode"] = "default"
+	_, err = cfg.promptMode(p)
+	if err == nil {
+		t.Errorf("Expected error for unknown mode")
+	}
+}
+
+func TestGetChangesTestsMode(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"a.go":      "package a\n",
+		"a_test.go": "package a\n",
+	})
+	// GPT tries to rewrite a.go, but tests mode must not let it
+	resp := fileResponse("a.go", "go", "package a\n\nvar broken\n") +
+		fileResponse("a_test.go", "go", "package a\n\n// new tests\n")
+	llm := &scriptedProvider{responses: []string{resp}}
+	p := &Prompt{In: []string{"*.go"}, Out: []string{"*.go"}, Mode: ModeTests, Txt: "add tests"}
+	_, err := getChanges(defaultConfig(), llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	_, _, err = applyPending(false)
+	if err != nil {
+		t.Fatalf("applyPending failed: %v", err)
+	}
+	got, _ := os.ReadFile("a.go")
+	if string(got) != "package a\n" {
+		t.Errorf("Expected a.go to be untouched, got: %q", got)
+	}
+	got, _ = os.ReadFile("a_test.go")
+	if !strings.Contains(string(got), "new tests") {
+		t.Errorf("Expected a_test.go to be updated, got: %q", got)
+	}
+	if !strings.Contains(llm.requests[0].sysmsg, "Append tests to\n[a_test.go]") {
+		t.Errorf("Expected tests sysmsg naming only the test file, got: %q", llm.requests[0].sysmsg)
+	}
+}
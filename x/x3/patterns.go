@@ -0,0 +1,158 @@
+package x3
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	gitignore "github.com/sabhiram/go-gitignore"
+	. "github.com/stevegt/goadapt"
+)
+
+// splitList splits a comma-separated header value into its trimmed,
+// non-empty elements.  An element holding a comma, a double quote, or
+// leading or trailing space is written as a Go string literal; see
+// joinList.
+func splitList(s string) (list []string) {
+	var raw []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == ',':
+			raw = append(raw, s[start:i])
+			start = i + 1
+		}
+	}
+	raw = append(raw, s[start:])
+	for _, item := range raw {
+		item = strings.TrimSpace(item)
+		if strings.HasPrefix(item, `"`) {
+			if unquoted, err := strconv.Unquote(item); err == nil {
+				item = unquoted
+			}
+		}
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
+// joinList joins list into a header value that splitList splits
+// back into list
+func joinList(list []string) string {
+	quoted := make([]string, len(list))
+	for i, item := range list {
+		quoted[i] = item
+		if strings.ContainsAny(item, `,"`) || item != strings.TrimSpace(item) {
+			quoted[i] = strconv.Quote(item)
+		}
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// isPattern returns true if pat should be matched against the list
+// of candidate files rather than used as a literal path.  Globs,
+// paths with a trailing slash, and existing directories are patterns.
+func isPattern(pat string) bool {
+	if strings.ContainsAny(pat, "*?[") || strings.HasSuffix(pat, "/") {
+		return true
+	}
+	info, err := os.Stat(pat)
+	return err == nil && info.IsDir()
+}
+
+// expandPatterns expands a list of file patterns such as the ones in
+// the In and Out prompt headers.  Patterns use the same syntax as
+// .aidda/ignore and are applied in order:  a pattern adds the
+// matching candidate files, and a pattern starting with '!' removes
+// them.  Literal paths are kept even if they are not in candidates,
+// so that e.g. an Out file can name a file that doesn't exist yet.
+func expandPatterns(patterns, candidates []string) (files []string) {
+	selected := make(map[string]bool)
+	var literals []string
+	for _, pat := range patterns {
+		negate := strings.HasPrefix(pat, "!")
+		if negate {
+			pat = pat[1:]
+		}
+		if pat == "" {
+			continue
+		}
+		if !isPattern(pat) {
+			fn := filepath.Clean(pat)
+			if !negate && !selected[fn] {
+				literals = append(literals, fn)
+			}
+			selected[fn] = !negate
+			continue
+		}
+		ig := gitignore.CompileIgnoreLines(pat)
+		for _, fn := range candidates {
+			if ig.MatchesPath(fn) {
+				selected[fn] = !negate
+			}
+		}
+	}
+	// keep candidates in walk order, followed by any literal paths
+	// that aren't candidates
+	seen := make(map[string]bool)
+	for _, fn := range candidates {
+		if selected[fn] && !seen[fn] {
+			files = append(files, fn)
+			seen[fn] = true
+		}
+	}
+	for _, fn := range literals {
+		if selected[fn] && !seen[fn] {
+			files = append(files, fn)
+			seen[fn] = true
+		}
+	}
+	return
+}
+
+// expandPromptFiles expands the In and Out patterns of a prompt
+// against the files returned by getFiles.  A literal In path must
+// exist, since GPT is sent its content, and must be one the ignore
+// files and the sandbox would let through; an Out path may not exist
+// yet.
+func expandPromptFiles(cfg *Config, p *Prompt) (inFns, outFns []string, err error) {
+	defer Return(&err)
+	candidates, err := getFiles(cfg)
+	Ck(err)
+	inFns = expandPatterns(p.In, candidates)
+	outFns = expandPatterns(p.Out, candidates)
+	where := "the prompt"
+	if p.path != "" {
+		where = p.path
+	}
+	var rules *ignoreRules
+	for _, fn := range inFns {
+		if contains(candidates, fn) {
+			continue
+		}
+		// outside the tree, or in .git or .aidda
+		reason, err := writePathRefusal(fn)
+		Ck(err)
+		Assert(reason == "", "%s: the In header names %s, which can't be sent: %s", where, fn, reason)
+		_, err = os.Stat(fn)
+		if os.IsNotExist(err) {
+			Assert(false, "%s: the In header names %s, which does not exist", where, fn)
+		}
+		Ck(err)
+		if rules == nil {
+			rules, err = newIgnoreRules(cfg.Discover == discoverWalk)
+			Ck(err)
+		}
+		included, reason, err := checkCandidate(rules, fn)
+		Ck(err)
+		Assert(included, "%s: the In header names %s, which can't be sent: %s", where, fn, reason)
+	}
+	return
+}
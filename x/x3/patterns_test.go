@@ -0,0 +1,115 @@
+package x3
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandPatterns(t *testing.T) {
+	candidates := []string{
+		"main.go",
+		"main_test.go",
+		"pkg/foo/foo.go",
+		"pkg/foo/foo_test.go",
+		"pkg/bar/bar.go",
+		"README.md",
+	}
+	cases := []struct {
+		patterns []string
+		want     []string
+	}{
+		// globs match at any depth
+		{[]string{"**/*.go", "!*_test.go"}, []string{"main.go", "pkg/foo/foo.go", "pkg/bar/bar.go"}},
+		// a trailing slash selects everything under a directory
+		{[]string{"pkg/foo/"}, []string{"pkg/foo/foo.go", "pkg/foo/foo_test.go"}},
+		// literal paths are kept even if they don't exist yet
+		{[]string{"README.md", "new.go"}, []string{"README.md", "new.go"}},
+		// later patterns override earlier ones
+		{[]string{"*.go", "!pkg/", "pkg/bar/bar.go"}, []string{"main.go", "main_test.go", "pkg/bar/bar.go"}},
+	}
+	for _, c := range cases {
+		got := expandPatterns(c.patterns, candidates)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("expandPatterns(%v): expected %v, got %v", c.patterns, c.want, got)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := splitList(" a.go,b.go , ,**/*.go")
+	want := []string{"a.go", "b.go", "**/*.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	// names with commas, quotes, or edge spaces are quoted
+	list := []string{"a,b.go", `say "hi".txt`, " lead.go", "plain name.go"}
+	joined := joinList(list)
+	if joined != `"a,b.go", "say \"hi\".txt", " lead.go", plain name.go` {
+		t.Errorf("Unexpected quoting: %s", joined)
+	}
+	if got := splitList(joined); !reflect.DeepEqual(got, list) {
+		t.Errorf("Expected %q, got %q", list, got)
+	}
+}
+
+func TestExpandPromptFilesMissing(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	p := &Prompt{In: []string{"a.go", "gone.go"}, Out: []string{"a.go", "new.go"}, path: ".aidda/prompt"}
+	_, _, err := expandPromptFiles(defaultConfig(), p)
+	if err == nil || !strings.Contains(err.Error(), "In header names gone.go") {
+		t.Fatalf("Expected an error naming the missing In file, got: %v", err)
+	}
+	// a missing Out file is one GPT is asked to create
+	p.In = []string{"a.go"}
+	inFns, outFns, err := expandPromptFiles(defaultConfig(), p)
+	if err != nil {
+		t.Fatalf("expandPromptFiles failed: %v", err)
+	}
+	if !reflect.DeepEqual(inFns, []string{"a.go"}) || !reflect.DeepEqual(outFns, []string{"a.go", "new.go"}) {
+		t.Errorf("Unexpected files: %v, %v", inFns, outFns)
+	}
+}
+
+func TestExpandPromptFilesRefused(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"sub/a.go":      "package a\n",
+		"sub/secret.go": "package a\n",
+		"outside.txt":   "secret\n",
+	})
+	err := os.Chdir("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(".aidda", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(".aidda/ignore", []byte("secret.go\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(".git", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(".git/config", []byte("[core]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fn, reason := range map[string]string{
+		".git/config":                     "inside .git",
+		".aidda/ignore":                   "inside .aidda",
+		"../outside.txt":                  "'..' in path",
+		filepath.Join(dir, "outside.txt"): "absolute path",
+		"secret.go":                       "matches 'secret.go'",
+	} {
+		p := &Prompt{In: []string{"a.go", fn}, Out: []string{"a.go"}}
+		_, _, err := expandPromptFiles(defaultConfig(), p)
+		if err == nil || !strings.Contains(err.Error(), "names "+fn+", which can't be sent: "+reason) {
+			t.Errorf("Expected %s to be refused (%s), got: %v", fn, reason, err)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package x3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/core"
+)
+
+// GPT's responses are staged in pendingDir until the user applies or
+// rejects them, so that a bad response never clobbers the working
+// tree
+const pendingDir = ".aidda/pending"
+
+// pendingManifest describes the staged change
+type pendingManifest struct {
+	Created time.Time
+	// HistoryID is the prompt round that produced the change
+	HistoryID string
+	Files     []pendingFile
+}
+
+// pendingFile is a single staged file
+type pendingFile struct {
+	// Path is relative to the top of the tree
+	Path string
+	// Base is the hash of the working tree file at the time the
+	// change was staged, or "" if the file did not exist
+	Base string
+}
+
+// pendingFilesDir returns the directory holding the staged files
+func pendingFilesDir() string {
+	return filepath.Join(pendingDir, "files")
+}
+
+// pendingManifestFn returns the path of the manifest
+func pendingManifestFn() string {
+	return filepath.Join(pendingDir, "manifest.json")
+}
+
+// hashFile returns the hash of a file's content, or "" if the file
+// does not exist
+func hashFile(fn string) (hash string, err error) {
+	defer Return(&err)
+	buf, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	Ck(err)
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashFiles returns the hash of each of fns, as hashFile does
+func hashFiles(fns []string) (hashes map[string]string, err error) {
+	defer Return(&err)
+	hashes = make(map[string]string)
+	for _, fn := range fns {
+		hashes[fn], err = hashFile(fn)
+		Ck(err)
+	}
+	return
+}
+
+// resetPending removes any previously staged change and creates an
+// empty pending directory
+func resetPending() (err error) {
+	defer Return(&err)
+	err = os.RemoveAll(pendingDir)
+	Ck(err)
+	err = os.MkdirAll(pendingFilesDir(), 0755)
+	Ck(err)
+	// keep 'git add -A' in commit from picking up staged files
+	err = os.WriteFile(filepath.Join(pendingDir, ".gitignore"), []byte("*\n"), 0644)
+	Ck(err)
+	return
+}
+
+// writePendingManifest records the staged files, along with the state
+// of the working tree, so apply can detect later edits.  bases holds
+// the hashes of the files as they were when they were sent to GPT;
+// files missing from bases are hashed now.  If there are no staged
+// files, it removes the pending directory instead.
+func writePendingManifest(staged []string, bases map[string]string, historyID string) (err error) {
+	defer Return(&err)
+	if len(staged) == 0 {
+		Pf("No files to stage\n")
+		err = os.RemoveAll(pendingDir)
+		Ck(err)
+		return
+	}
+	manifest := &pendingManifest{Created: time.Now(), HistoryID: historyID}
+	for _, fn := range staged {
+		base, ok := bases[fn]
+		if !ok {
+			base, err = hashFile(fn)
+			Ck(err)
+		}
+		manifest.Files = append(manifest.Files, pendingFile{Path: fn, Base: base})
+	}
+	buf, err := json.MarshalIndent(manifest, "", "    ")
+	Ck(err)
+	err = os.WriteFile(pendingManifestFn(), buf, 0644)
+	Ck(err)
+	Pf("Staged %d files in %s; run 'show', 'apply', or 'reject'\n", len(staged), pendingDir)
+	return
+}
+
+// stagePendingFiles stages the given file contents, replacing any
+// previously staged change
+func stagePendingFiles(files map[string][]byte, historyID string) (staged []string, err error) {
+	defer Return(&err)
+	err = resetPending()
+	Ck(err)
+	for fn, buf := range files {
+		path := filepath.Join(pendingFilesDir(), fn)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		Ck(err)
+		err = os.WriteFile(path, buf, 0644)
+		Ck(err)
+		staged = append(staged, fn)
+	}
+	sort.Strings(staged)
+	err = writePendingManifest(staged, nil, historyID)
+	Ck(err)
+	return
+}
+
+// stagePending extracts the files in resp into the pending directory,
+// replacing any previously staged change.  bases holds the hashes of
+// the Out files as they were sent; see writePendingManifest.  Files in
+// resp that aren't in outFls are not extracted, and are returned in
+// rejected.
+func stagePending(outFls []core.FileLang, resp string, bases map[string]string, historyID string) (staged []string, rejected []rejectedWrite, err error) {
+	defer Return(&err)
+	rejected = undeclaredFiles(resp, outFls)
+	err = resetPending()
+	Ck(err)
+	staged, err = extractFiles(pendingFilesDir(), outFls, resp)
+	Ck(err)
+	err = writePendingManifest(staged, bases, historyID)
+	Ck(err)
+	return
+}
+
+// extractFiles writes each file in outFls that resp contains under
+// dir, and returns the ones it found.  It reads the format that
+// grokker's core.ExtractFiles does, but that writes relative to the
+// current directory.
+func extractFiles(dir string, outFls []core.FileLang, resp string) (found []string, err error) {
+	defer Return(&err)
+	for _, fl := range outFls {
+		fn := regexp.QuoteMeta(fl.File)
+		re := regexp.MustCompile(Spf(`(?:^|\n)(?i)File:\s*(%s)\s*\n`, fn) +
+			"```" + Spf(`(%s)\n`, regexp.QuoteMeta(fl.Language)) +
+			`(?s)(.*)` +
+			"```" + Spf(`\nEOF_%s(?:\s*|\n)*`, fn))
+		m := re.FindStringSubmatch(resp)
+		if m == nil {
+			Fpf(os.Stderr, "Warning: file not found in the response: '%s'\n", fl.File)
+			continue
+		}
+		path := filepath.Join(dir, fl.File)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		Ck(err)
+		err = os.WriteFile(path, []byte(m[3]), 0644)
+		Ck(err)
+		found = append(found, fl.File)
+	}
+	sort.Strings(found)
+	return
+}
+
+// readPending reads the manifest of the staged change.  It returns
+// nil if there is no staged change.
+func readPending() (manifest *pendingManifest, err error) {
+	defer Return(&err)
+	buf, err := os.ReadFile(pendingManifestFn())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	Ck(err)
+	manifest = &pendingManifest{}
+	err = json.Unmarshal(buf, manifest)
+	Ck(err)
+	return
+}
+
+// applyPending moves the staged files into the working tree.  If any
+// of the working tree files changed since the change was staged,
+// applyPending returns them as conflicts and applies nothing unless
+// force is true.
+func applyPending(force bool) (applied, conflicts []string, err error) {
+	defer Return(&err)
+	manifest, err := readPending()
+	Ck(err)
+	Assert(manifest != nil, "no pending change")
+	for _, f := range manifest.Files {
+		// the tree may have changed since the files were staged
+		reason, err := writePathRefusal(f.Path)
+		Ck(err)
+		Assert(reason == "", "refusing to write %s: %s", f.Path, reason)
+		hash, err := hashFile(f.Path)
+		Ck(err)
+		if hash != f.Base {
+			conflicts = append(conflicts, f.Path)
+		}
+	}
+	if len(conflicts) > 0 && !force {
+		return
+	}
+	for _, f := range manifest.Files {
+		buf, err := os.ReadFile(filepath.Join(pendingFilesDir(), f.Path))
+		Ck(err)
+		dir := filepath.Dir(f.Path)
+		err = os.MkdirAll(dir, 0755)
+		Ck(err)
+		err = os.WriteFile(f.Path, buf, 0644)
+		Ck(err)
+		applied = append(applied, f.Path)
+	}
+	err = os.RemoveAll(pendingDir)
+	Ck(err)
+	err = markHistoryApplied(manifest.HistoryID)
+	Ck(err)
+	return
+}
+
+// rejectPending discards the staged change
+func rejectPending() (err error) {
+	defer Return(&err)
+	manifest, err := readPending()
+	Ck(err)
+	Assert(manifest != nil, "no pending change")
+	err = os.RemoveAll(pendingDir)
+	Ck(err)
+	Pf("Discarded %d pending files\n", len(manifest.Files))
+	return
+}
+
+// showPending prints a diff of the staged change against the working
+// tree
+func showPending() (err error) {
+	defer Return(&err)
+	manifest, err := readPending()
+	Ck(err)
+	Assert(manifest != nil, "no pending change")
+	for _, f := range manifest.Files {
+		old := f.Path
+		if _, err := os.Stat(old); os.IsNotExist(err) {
+			old = os.DevNull
+		}
+		// git diff exits 1 if the files differ
+		stdout, stderr, rc, err := Run("git diff --no-index -- "+quoteArgs(old, filepath.Join(pendingFilesDir(), f.Path)), nil)
+		Ck(err)
+		Assert(rc <= 1, "git diff of %s failed: %s", f.Path, strings.TrimSpace(string(stderr)))
+		Pf("%s", stdout)
+	}
+	return
+}
+
+// applyPendingInteractive applies the staged change, asking the user
+// before overwriting files that changed since the change was staged
+func applyPendingInteractive() (err error) {
+	defer Return(&err)
+	applied, conflicts, err := applyPending(false)
+	Ck(err)
+	if len(conflicts) > 0 {
+		for _, fn := range conflicts {
+			Pf("%s has changed since the response was staged\n", fn)
+		}
+		res, err := ask("Overwrite these files?", "n", "y")
+		Ck(err)
+		if strings.ToLower(res) != "y" {
+			Pf("Not applied; run 'show' to review or 'reject' to discard\n")
+			return nil
+		}
+		applied, _, err = applyPending(true)
+		Ck(err)
+	}
+	Pf("Applied %d files\n", len(applied))
+	return
+}
@@ -0,0 +1,127 @@
+package x3
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/stevegt/grokker/v3/core"
+)
+
+func TestPendingApply(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	outFls := []core.FileLang{{File: "a.go", Language: "go"}, {File: "sub/b.go", Language: "go"}}
+	resp := fileResponse("a.go", "go", "package a // new\n") + fileResponse("sub/b.go", "go", "package sub\n")
+	staged, _, err := stagePending(outFls, resp, nil, "")
+	if err != nil {
+		t.Fatalf("stagePending failed: %v", err)
+	}
+	if !reflect.DeepEqual(staged, []string{"a.go", "sub/b.go"}) {
+		t.Errorf("Unexpected staged files: %v", staged)
+	}
+	// staging must not touch the working tree
+	got, _ := os.ReadFile("a.go")
+	if string(got) != "package a\n" {
+		t.Errorf("Expected a.go to be untouched, got: %q", got)
+	}
+	applied, conflicts, err := applyPending(false)
+	if err != nil {
+		t.Fatalf("applyPending failed: %v", err)
+	}
+	if len(applied) != 2 || len(conflicts) != 0 {
+		t.Errorf("Expected 2 applied and no conflicts, got: %v %v", applied, conflicts)
+	}
+	got, _ = os.ReadFile("sub/b.go")
+	if string(got) != "package sub\n" {
+		t.Errorf("Expected sub/b.go to be created, got: %q", got)
+	}
+	manifest, err := readPending()
+	if err != nil || manifest != nil {
+		t.Errorf("Expected no pending change after apply, got: %v %v", manifest, err)
+	}
+}
+
+func TestPendingConflict(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	outFls := []core.FileLang{{File: "a.go", Language: "go"}}
+	_, _, err := stagePending(outFls, fileResponse("a.go", "go", "package a // gpt\n"), nil, "")
+	if err != nil {
+		t.Fatalf("stagePending failed: %v", err)
+	}
+	// the user edits the file while the change is pending
+	err = os.WriteFile("a.go", []byte("package a // manual\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, conflicts, err := applyPending(false)
+	if err != nil {
+		t.Fatalf("applyPending failed: %v", err)
+	}
+	if len(applied) != 0 || !reflect.DeepEqual(conflicts, []string{"a.go"}) {
+		t.Errorf("Expected a.go conflict and nothing applied, got: %v %v", applied, conflicts)
+	}
+	got, _ := os.ReadFile("a.go")
+	if string(got) != "package a // manual\n" {
+		t.Errorf("Expected manual edit to survive, got: %q", got)
+	}
+	err = rejectPending()
+	if err != nil {
+		t.Fatalf("rejectPending failed: %v", err)
+	}
+	manifest, _ := readPending()
+	if manifest != nil {
+		t.Errorf("Expected no pending change after reject")
+	}
+}
+
+// editingProvider is a scriptedProvider that runs edit while GPT is
+// thinking
+type editingProvider struct {
+	scriptedProvider
+	edit func()
+}
+
+// Send implements Provider
+func (llm *editingProvider) Send(sysmsg string, msgs []core.ChatMsg, inFns []string, outFls []core.FileLang) (resp string, err error) {
+	llm.edit()
+	return llm.scriptedProvider.Send(sysmsg, msgs, inFns, outFls)
+}
+
+func TestPendingEditWhileWaiting(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	llm := &editingProvider{
+		scriptedProvider: scriptedProvider{responses: []string{fileResponse("a.go", "go", "package a // gpt\n")}},
+		edit:             func() { os.WriteFile("a.go", []byte("package a // manual\n"), 0644) },
+	}
+	p := &Prompt{In: []string{"a.go"}, Out: []string{"a.go"}, Txt: "change a.go"}
+	_, err := getChanges(defaultConfig(), llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	// the edit was made after a.go was sent, so it conflicts
+	applied, conflicts, err := applyPending(false)
+	if err != nil {
+		t.Fatalf("applyPending failed: %v", err)
+	}
+	if len(applied) != 0 || !reflect.DeepEqual(conflicts, []string{"a.go"}) {
+		t.Errorf("Expected a.go conflict and nothing applied, got: %v %v", applied, conflicts)
+	}
+	got, _ := os.ReadFile("a.go")
+	if string(got) != "package a // manual\n" {
+		t.Errorf("Expected manual edit to survive, got: %q", got)
+	}
+}
+
+func TestShowPendingQuoting(t *testing.T) {
+	chdirTemp(t, map[string]string{"a b.go": "package a\n"})
+	outFls := []core.FileLang{{File: "a b.go", Language: "go"}, {File: "new $x.go", Language: "go"}}
+	resp := fileResponse("a b.go", "go", "package a // gpt\n") + fileResponse("new $x.go", "go", "package a\n")
+	_, _, err := stagePending(outFls, resp, nil, "")
+	if err != nil {
+		t.Fatalf("stagePending failed: %v", err)
+	}
+	err = showPending()
+	if err != nil {
+		t.Errorf("showPending failed: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package x3
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	. "github.com/stevegt/goadapt"
+	"golang.org/x/tools/go/packages"
+)
+
+// ranks of the files chosen by packageContext, most relevant first
+const (
+	rankOut = iota
+	rankSamePackage
+	rankImport
+	rankImporter
+)
+
+// packageContext picks the files in inFns that belong to the Go
+// packages containing the Out files, the packages they import from
+// the same module, and the packages in the module that import them.
+// Files are returned in rank order, and In files outside that graph
+// are left out.
+func packageContext(inFns, outFns []string) (selected []contextFile, err error) {
+	defer Return(&err)
+	cwd, err := os.Getwd()
+	Ck(err)
+	cfg := &packages.Config{
+		Mode:  packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedModule | packages.NeedForTest,
+		Tests: true,
+	}
+	pkgs, err := packages.Load(cfg, "./...")
+	Ck(err)
+
+	// index the packages by import path, merging test variants, and
+	// map each file to its package
+	files := make(map[string][]string)
+	imports := make(map[string]map[string]bool)
+	importers := make(map[string]map[string]bool)
+	dirs := make(map[string]string)
+	modPath := ""
+	for _, pkg := range pkgs {
+		if pkg.Module != nil && pkg.Module.Main {
+			modPath = pkg.Module.Path
+		}
+	}
+	for _, pkg := range pkgs {
+		if pkg.Module == nil || pkg.Module.Path != modPath {
+			continue
+		}
+		// e.g. "example.com/a [example.com/a.test]" and
+		// "example.com/a_test" are both reported as example.com/a
+		path := pkg.PkgPath
+		if pkg.ForTest != "" {
+			path = pkg.ForTest
+		}
+		if imports[path] == nil {
+			imports[path] = make(map[string]bool)
+		}
+		for _, fn := range pkg.GoFiles {
+			rel, err := filepath.Rel(cwd, fn)
+			Ck(err)
+			if !contains(files[path], rel) {
+				files[path] = append(files[path], rel)
+			}
+			dirs[path] = filepath.Dir(rel)
+		}
+		for imp, ipkg := range pkg.Imports {
+			if ipkg.Module == nil || ipkg.Module.Path != modPath || imp == path {
+				continue
+			}
+			imports[path][imp] = true
+			if importers[imp] == nil {
+				importers[imp] = make(map[string]bool)
+			}
+			importers[imp][path] = true
+		}
+	}
+
+	// rank the files
+	ranks := make(map[string]int)
+	reasons := make(map[string]string)
+	add := func(fn string, rank int, reason string) {
+		if !contains(inFns, fn) {
+			return
+		}
+		if r, ok := ranks[fn]; ok && r <= rank {
+			return
+		}
+		ranks[fn] = rank
+		reasons[fn] = reason
+	}
+	var seeds []string
+	for _, fn := range outFns {
+		add(fn, rankOut, "Out file")
+		// an Out file may not exist yet, so go by its directory
+		for path, dir := range dirs {
+			if dir == filepath.Dir(filepath.Clean(fn)) && !contains(seeds, path) {
+				seeds = append(seeds, path)
+			}
+		}
+	}
+	sort.Strings(seeds)
+	for _, seed := range seeds {
+		for _, fn := range files[seed] {
+			add(fn, rankSamePackage, Spf("in package %s with an Out file", seed))
+		}
+		for _, imp := range sortedKeys(imports[seed]) {
+			for _, fn := range files[imp] {
+				add(fn, rankImport, Spf("in package %s, imported by %s", imp, seed))
+			}
+		}
+		for _, imp := range sortedKeys(importers[seed]) {
+			for _, fn := range files[imp] {
+				add(fn, rankImporter, Spf("in package %s, which imports %s", imp, seed))
+			}
+		}
+	}
+
+	for fn, reason := range reasons {
+		selected = append(selected, contextFile{Fn: fn, Reason: reason})
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		ri, rj := ranks[selected[i].Fn], ranks[selected[j].Fn]
+		if ri != rj {
+			return ri < rj
+		}
+		return selected[i].Fn < selected[j].Fn
+	})
+	return
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]bool) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
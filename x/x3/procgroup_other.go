@@ -0,0 +1,9 @@
+//go:build !unix
+
+package x3
+
+import "os/exec"
+
+// setProcessGroup does nothing on this platform; cancellation kills
+// only the command itself
+func setProcessGroup(cobj *exec.Cmd) {}
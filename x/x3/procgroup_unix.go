@@ -0,0 +1,17 @@
+//go:build unix
+
+package x3
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cobj in a new process group, and makes
+// cancellation kill the whole group
+func setProcessGroup(cobj *exec.Cmd) {
+	cobj.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cobj.Cancel = func() error {
+		return syscall.Kill(-cobj.Process.Pid, syscall.SIGKILL)
+	}
+}
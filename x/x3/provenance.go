@@ -0,0 +1,125 @@
+package x3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// provenance trailers, added for each prompt round in a commit after
+// its Aidda-Round trailer
+const (
+	trailerModel     = "Aidda-Model"
+	trailerMode      = "Aidda-Mode"
+	trailerIteration = "Aidda-Iteration"
+	trailerTokens    = "Aidda-Tokens"
+	// trailerPromptSha is the sha256 of the prompt text, so a
+	// reviewer can check it against the recorded prompt
+	trailerPromptSha = "Aidda-Prompt-Sha"
+)
+
+// promptSha returns the value of the Aidda-Prompt-Sha trailer for rec
+func promptSha(rec *historyRecord) string {
+	sum := sha256.Sum256([]byte(rec.Prompt))
+	return hex.EncodeToString(sum[:])
+}
+
+// totalTokens returns the number of tokens sent in rec
+func totalTokens(rec *historyRecord) (total int) {
+	for _, tc := range rec.TokenCounts {
+		total += tc.Count
+	}
+	return
+}
+
+// provenanceTrailers returns the trailers that record how the given
+// prompt rounds were produced
+func provenanceTrailers(ids []string) (trailers []trailer, err error) {
+	defer Return(&err)
+	for _, id := range ids {
+		rec, err := loadHistory(id)
+		Ck(err)
+		trailers = append(trailers,
+			trailer{trailerRound, id},
+			trailer{trailerModel, rec.Model},
+			trailer{trailerMode, rec.Mode},
+		)
+		if rec.Iteration > 0 {
+			trailers = append(trailers, trailer{trailerIteration, strconv.Itoa(rec.Iteration)})
+		}
+		trailers = append(trailers,
+			trailer{trailerTokens, strconv.Itoa(totalTokens(rec))},
+			trailer{trailerPromptSha, promptSha(rec)},
+		)
+	}
+	return
+}
+
+// commitProvenance returns the subject and trailers of commit, and
+// the history records of the prompt rounds it includes.  Rounds with
+// no record in .aidda/history, e.g. because they were sent from
+// another clone, are returned in missing.
+func commitProvenance(commit string) (subject, trailers string, recs []*historyRecord, missing []string, err error) {
+	defer Return(&err)
+	stdout, err := runOk(Spf("git log -n 1 --format=%%s %s", commit), nil)
+	Ck(err)
+	subject = strings.TrimSpace(string(stdout))
+	stdout, err = runOk(Spf("git log -n 1 --format=%%(trailers) %s", commit), nil)
+	Ck(err)
+	trailers = strings.TrimSpace(string(stdout))
+	stdout, err = runOk(Spf("git log -n 1 --format=%%(trailers:key=%s,valueonly,separator=%%x2C) %s", trailerRound, commit), nil)
+	Ck(err)
+	for _, id := range splitList(string(stdout)) {
+		_, err = os.Stat(historyFn(id))
+		if os.IsNotExist(err) {
+			missing = append(missing, id)
+			continue
+		}
+		rec, err := loadHistory(id)
+		Ck(err)
+		recs = append(recs, rec)
+	}
+	return subject, trailers, recs, missing, nil
+}
+
+// showProvenance prints the prompts and responses behind commit
+func showProvenance(commit string) (err error) {
+	defer Return(&err)
+	subject, trailers, recs, missing, err := commitProvenance(commit)
+	Ck(err)
+	Pf("commit %s\n    %s\n\n", commit, subject)
+	if len(recs) == 0 && len(missing) == 0 {
+		Pf("Not applied by aidda\n")
+		return
+	}
+	Pf("%s\n", trailers)
+	for _, id := range missing {
+		Pf("\nRound %s: no record in %s; it may have been sent from another clone\n", id, historyDir)
+	}
+	for _, rec := range recs {
+		Pf("\nRound %s  %s\n", rec.ID, rec.Time.Format(time.RFC1123))
+		Pf("    model %s, mode %s, %d tokens, %s\n", rec.Model, rec.Mode, totalTokens(rec), rec.Elapsed.Round(time.Millisecond))
+		if rec.Iteration > 0 {
+			Pf("    loop iteration %d\n", rec.Iteration)
+		}
+		Pf("    prompt sha %s\n", promptSha(rec))
+		Pf("    in:  %s\n", strings.Join(rec.In, " "))
+		Pf("    out: %s\n", strings.Join(rec.Out, " "))
+		Pf("\n--- sysmsg ---\n%s\n", rec.Sysmsg)
+		Pf("\n--- prompt ---\n%s\n", rec.Prompt)
+		for _, a := range rec.Attachments {
+			Pf("\n--- attachment %s ---\n%s\n", a.Name, a.Body)
+		}
+		for i, c := range rec.Corrections {
+			Pf("\n--- response %d, which had errors ---\n%s\n", i+1, c.Response)
+			Pf("\n--- errors sent back ---\n%s\n", c.Errors)
+		}
+		Pf("\n--- response ---\n%s\n", rec.Response)
+	}
+	return
+}
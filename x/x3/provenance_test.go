@@ -0,0 +1,73 @@
+package x3
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	gitInit(t)
+	cfg := defaultConfig()
+	cfg.Gate = gateOff
+	llm := &scriptedProvider{responses: []string{fileResponse("a.go", "go", "package a // new\n")}}
+	p := &Prompt{In: []string{"a.go"}, Out: []string{"a.go"}, Txt: "change a"}
+	rec, err := getChanges(cfg, llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	rec.Iteration = 2
+	err = saveHistory(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = applyPending(false)
+	if err != nil {
+		t.Fatalf("applyPending failed: %v", err)
+	}
+	err = commit(cfg, llm, "")
+	if err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+
+	out, err := exec.Command("git", "log", "-n", "1", "--format=%(trailers)").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		trailerRound + ": " + rec.ID,
+		trailerModel + ": " + cfg.Model,
+		trailerMode + ": " + ModeCustom,
+		trailerIteration + ": 2",
+		trailerPromptSha + ": " + promptSha(rec),
+		trailerTokens + ": ",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("Expected trailer %q, got:\n%s", want, out)
+		}
+	}
+
+	subject, _, recs, missing, err := commitProvenance("HEAD")
+	if err != nil {
+		t.Fatalf("commitProvenance failed: %v", err)
+	}
+	if subject != "scripted commit message" || len(recs) != 1 || recs[0].Prompt != "change a" || len(missing) != 0 {
+		t.Errorf("Unexpected provenance: %q %#v %v", subject, recs, missing)
+	}
+	err = showProvenance("HEAD")
+	if err != nil {
+		t.Fatalf("showProvenance failed: %v", err)
+	}
+
+	// rounds sent from another clone have no local record
+	err = os.RemoveAll(historyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, recs, missing, err = commitProvenance("HEAD")
+	if err != nil || len(recs) != 0 || len(missing) != 1 || missing[0] != rec.ID {
+		t.Errorf("Expected the round to be missing, got: %v %v %v", recs, missing, err)
+	}
+}
@@ -0,0 +1,50 @@
+package x3
+
+import (
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/core"
+)
+
+// Provider is an LLM backend.  The grokker implementation talks to
+// the OpenAI API; tests use a scripted fake.
+type Provider interface {
+	// Send sends a system message, chat messages, and the contents
+	// of inFns, asking for outFls to be returned in the response
+	Send(sysmsg string, msgs []core.ChatMsg, inFns []string, outFls []core.FileLang) (resp string, err error)
+	// TokenCount returns the number of tokens in text
+	TokenCount(text string) (count int, err error)
+	// DiffSummary returns a commit message summarizing the output
+	// of 'git diff' run with args
+	DiffSummary(args ...string) (msg string, err error)
+}
+
+// grokkerProvider is a Provider backed by a grokker database
+type grokkerProvider struct {
+	g *core.Grokker
+}
+
+// newGrokkerProvider opens or creates the grokker database in base.
+// The caller must call unlock when done.
+func newGrokkerProvider(base, model string) (llm *grokkerProvider, unlock func() error, err error) {
+	defer Return(&err)
+	g, lock, err := core.LoadOrInit(base, model)
+	Ck(err)
+	llm = &grokkerProvider{g: g}
+	unlock = lock.Unlock
+	return
+}
+
+// Send implements Provider
+func (llm *grokkerProvider) Send(sysmsg string, msgs []core.ChatMsg, inFns []string, outFls []core.FileLang) (resp string, err error) {
+	return llm.g.SendWithFiles(sysmsg, msgs, inFns, outFls)
+}
+
+// TokenCount implements Provider
+func (llm *grokkerProvider) TokenCount(text string) (count int, err error) {
+	return llm.g.TokenCount(text)
+}
+
+// DiffSummary implements Provider
+func (llm *grokkerProvider) DiffSummary(args ...string) (msg string, err error) {
+	return llm.g.GitCommitMessage(args...)
+}
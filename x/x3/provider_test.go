@@ -0,0 +1,148 @@
+package x3
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stevegt/grokker/v3/core"
+)
+
+// scriptedProvider is a deterministic Provider for tests.  Each call
+// to Send returns the next scripted response and records the request.
+type scriptedProvider struct {
+	responses []string
+	requests  []scriptedRequest
+}
+
+// scriptedRequest is a request recorded by scriptedProvider
+type scriptedRequest struct {
+	sysmsg string
+	msgs   []core.ChatMsg
+	inFns  []string
+	outFls []core.FileLang
+	// files holds the content of each file as the provider got it,
+	// whether read from inFns or sent as a message by sendViews
+	files map[string]string
+}
+
+// fileMsgRe matches a file sent as a message by sendViews
+var fileMsgRe = regexp.MustCompile("(?s)^File: (\\S+)\n```\n(.*)```\n$")
+
+// Send implements Provider
+func (llm *scriptedProvider) Send(sysmsg string, msgs []core.ChatMsg, inFns []string, outFls []core.FileLang) (resp string, err error) {
+	files := make(map[string]string)
+	for _, fn := range inFns {
+		buf, err := os.ReadFile(fn)
+		if err != nil {
+			return "", err
+		}
+		files[fn] = string(buf)
+	}
+	for _, msg := range msgs {
+		if m := fileMsgRe.FindStringSubmatch(msg.Txt); m != nil {
+			files[m[1]] = m[2]
+		}
+	}
+	llm.requests = append(llm.requests, scriptedRequest{sysmsg, msgs, inFns, outFls, files})
+	if len(llm.responses) == 0 {
+		return "", fmt.Errorf("scriptedProvider: no more responses")
+	}
+	resp = llm.responses[0]
+	llm.responses = llm.responses[1:]
+	return
+}
+
+// TokenCount implements Provider
+func (llm *scriptedProvider) TokenCount(text string) (count int, err error) {
+	return len(strings.Fields(text)), nil
+}
+
+// DiffSummary implements Provider
+func (llm *scriptedProvider) DiffSummary(args ...string) (msg string, err error) {
+	return "scripted commit message", nil
+}
+
+// fileResponse formats a file the way the model returns it
+func fileResponse(fn, lang, txt string) string {
+	return fmt.Sprintf("File: %s\n```%s\n%s```\nEOF_%s\n", fn, lang, txt, fn)
+}
+
+// chdirTemp changes to a new temporary directory containing an
+// .aidda/ignore file and the given files, and changes back when
+// the test is done
+func chdirTemp(t *testing.T, files map[string]string) (dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	orig, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(orig) })
+	err = os.MkdirAll(".aidda", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ensureIgnoreFile(defaultConfig(), ".aidda/ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fn, txt := range files {
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fn, []byte(txt), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func TestGetChangesScripted(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"a.go": "package a\n",
+		"b.go": "package a\n",
+	})
+	want := "package a\n\nfunc A() int { return 1 }\n"
+	llm := &scriptedProvider{responses: []string{fileResponse("a.go", "go", want)}}
+	p := &Prompt{In: []string{"*.go"}, Out: []string{"a.go"}, Txt: "add func A"}
+	p.SetAttachment(attachTestResults, "Test results: FAIL\n")
+	_, err := getChanges(defaultConfig(), llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	_, _, err = applyPending(false)
+	if err != nil {
+		t.Fatalf("applyPending failed: %v", err)
+	}
+	got, err := os.ReadFile("a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("Expected a.go to be %q, got: %q", want, got)
+	}
+	if len(llm.requests) != 1 {
+		t.Fatalf("Expected 1 request, got: %d", len(llm.requests))
+	}
+	req := llm.requests[0]
+	if strings.Join(req.inFns, ",") != "a.go,b.go" {
+		t.Errorf("Expected In patterns to be expanded, got: %v", req.inFns)
+	}
+	// the prompt text and the attachment are sent separately
+	if len(req.msgs) != 2 || req.msgs[0].Txt != "add func A" {
+		t.Fatalf("Unexpected messages: %v", req.msgs)
+	}
+	if !strings.Contains(req.msgs[1].Txt, attachTestResults) {
+		t.Errorf("Expected attachment to be labeled, got: %q", req.msgs[1].Txt)
+	}
+}
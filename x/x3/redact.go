@@ -0,0 +1,330 @@
+package x3
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/core"
+)
+
+// redact settings decide whether secrets are masked before anything is
+// sent to the model provider
+const (
+	redactOn  = "on"
+	redactOff = "off"
+)
+
+// checkRedact returns an error if setting is not a known redact setting
+func checkRedact(setting string) (err error) {
+	defer Return(&err)
+	switch setting {
+	case redactOn, redactOff:
+	default:
+		Assert(false, "unknown redact setting %q; expected %s or %s", setting, redactOn, redactOff)
+	}
+	return
+}
+
+// redactPatternsFn is the file of extra secret patterns, one regular
+// expression per line
+const redactPatternsFn = ".aidda/redact"
+
+// placeholderPrefix starts every placeholder.  The rest of the
+// placeholder is derived from the secret, so the same secret gets the
+// same placeholder in every file and every round.
+const placeholderPrefix = "AIDDA_REDACTED_"
+
+// secretPattern is a regular expression that matches a secret.  If
+// the expression has a group, only the first group is masked.
+type secretPattern struct {
+	Kind string
+	Re   *regexp.Regexp
+}
+
+// knownSecretPatterns match well-known credential formats
+var knownSecretPatterns = []secretPattern{
+	{"private key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{"AWS access key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"Stripe key", regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+	{"API key", regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{20,}`)},
+	{"JWT", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`)},
+	{"URL password", regexp.MustCompile(`[a-z][a-z0-9+.-]*://[^\s:@/]+:([^\s@/]{3,})@`)},
+}
+
+// assignmentRe matches a value assigned to a name that suggests a
+// secret, e.g. DB_PASSWORD=... or "api_key": "..."
+var assignmentRe = regexp.MustCompile(`(?i)[\w.-]*(?:password|passwd|secret|token|api[_-]?key|access[_-]?key|auth[_-]?key|credential)[\w.-]*["']?\s*[:=]\s*["']?([^\s"'` + "`" + `,;()]{8,})`)
+
+// entropyTokenRe matches the runs of characters that random tokens are
+// made of
+var entropyTokenRe = regexp.MustCompile(`[A-Za-z0-9+/_=-]{32,}`)
+
+const (
+	// minTokenEntropy is the Shannon entropy, in bits per character,
+	// above which a long token is taken to be random.  English text
+	// and identifiers stay well below it; hex hashes can't reach it.
+	minTokenEntropy = 4.5
+	// minAssignmentEntropy is the entropy a value assigned to a
+	// secret-sounding name needs, so that e.g. token = tokenizer.Next
+	// isn't masked
+	minAssignmentEntropy = 3.0
+)
+
+// redaction is a secret that was masked
+type redaction struct {
+	// Source is the file or message the secret was found in
+	Source      string
+	Line        int
+	Kind        string
+	Placeholder string
+}
+
+// redactor masks secrets and restores them.  The zero value masks
+// nothing.
+type redactor struct {
+	patterns []secretPattern
+	// secrets maps each placeholder to the secret it replaced
+	secrets map[string]string
+	found   []redaction
+}
+
+// newRedactor returns a redactor for the redact setting, with the
+// known patterns and any extra ones in redactPatternsFn
+func newRedactor(cfg *Config) (r *redactor, err error) {
+	defer Return(&err)
+	r = &redactor{secrets: make(map[string]string)}
+	if cfg.Redact == redactOff {
+		return
+	}
+	r.patterns = append(r.patterns, knownSecretPatterns...)
+	extra, err := readRedactPatterns(redactPatternsFn)
+	Ck(err)
+	r.patterns = append(r.patterns, extra...)
+	return
+}
+
+// readRedactPatterns reads the extra secret patterns in fn, if it
+// exists.  Blank lines and lines starting with # are skipped.
+func readRedactPatterns(fn string) (patterns []secretPattern, err error) {
+	defer Return(&err)
+	file, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	Ck(err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		Ck(err, Spf("%s:%d", fn, n))
+		patterns = append(patterns, secretPattern{Kind: Spf("%s:%d", fn, n), Re: re})
+	}
+	Ck(scanner.Err())
+	return
+}
+
+// placeholder returns the placeholder for secret
+func placeholder(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return placeholderPrefix + strings.ToUpper(hex.EncodeToString(sum[:6]))
+}
+
+// entropy returns the Shannon entropy of s in bits per character
+func entropy(s string) (bits float64) {
+	counts := make(map[rune]int)
+	n := 0
+	for _, c := range s {
+		counts[c]++
+		n++
+	}
+	for _, count := range counts {
+		p := float64(count) / float64(n)
+		bits -= p * math.Log2(p)
+	}
+	return
+}
+
+// randomToken returns true if tok looks like a random token rather
+// than a word, identifier, or hash
+func randomToken(tok string) bool {
+	var lower, upper, digit bool
+	for _, c := range tok {
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+	}
+	return lower && upper && digit && entropy(tok) >= minTokenEntropy
+}
+
+// span is a part of a text to mask
+type span struct {
+	start, end int
+	kind       string
+}
+
+// redact returns txt with its secrets replaced by placeholders.
+// source names txt in the report.
+func (r *redactor) redact(source, txt string) string {
+	if r.patterns == nil {
+		return txt
+	}
+	var spans []span
+	add := func(start, end int, kind string) {
+		secret := txt[start:end]
+		if strings.HasPrefix(secret, placeholderPrefix) {
+			return
+		}
+		for _, s := range spans {
+			if start < s.end && s.start < end {
+				return
+			}
+		}
+		spans = append(spans, span{start, end, kind})
+	}
+	// known and configured formats first, so they are reported by
+	// name, then the heuristics
+	for _, pat := range r.patterns {
+		for _, m := range pat.Re.FindAllStringSubmatchIndex(txt, -1) {
+			if len(m) >= 4 && m[2] >= 0 {
+				add(m[2], m[3], pat.Kind)
+			} else if len(m) < 4 {
+				add(m[0], m[1], pat.Kind)
+			}
+		}
+	}
+	for _, m := range assignmentRe.FindAllStringSubmatchIndex(txt, -1) {
+		value := txt[m[2]:m[3]]
+		if strings.ContainsAny(value, "0123456789") && entropy(value) >= minAssignmentEntropy {
+			add(m[2], m[3], "assigned secret")
+		}
+	}
+	for _, m := range entropyTokenRe.FindAllStringIndex(txt, -1) {
+		if randomToken(txt[m[0]:m[1]]) {
+			add(m[0], m[1], "high-entropy string")
+		}
+	}
+	if len(spans) == 0 {
+		return txt
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var b strings.Builder
+	last := 0
+	for _, s := range spans {
+		secret := txt[s.start:s.end]
+		ph := placeholder(secret)
+		r.secrets[ph] = secret
+		r.found = append(r.found, redaction{
+			Source:      source,
+			Line:        strings.Count(txt[:s.start], "\n") + 1,
+			Kind:        s.kind,
+			Placeholder: ph,
+		})
+		b.WriteString(txt[last:s.start])
+		b.WriteString(ph)
+		last = s.end
+	}
+	b.WriteString(txt[last:])
+	return b.String()
+}
+
+// redactFiles returns the text of each file in fns as it is sent:
+// its view (see fileView), with its secrets masked.  views holds just
+// the files whose text differs from what is on disk.
+func (r *redactor) redactFiles(fns []string, maxSize int) (texts, views map[string]string, err error) {
+	defer Return(&err)
+	texts = make(map[string]string)
+	views = make(map[string]string)
+	for _, fn := range fns {
+		view, full, err := fileView(fn, maxSize)
+		Ck(err)
+		masked := r.redact(fn, view)
+		if !full || masked != view {
+			views[fn] = masked
+		}
+		texts[fn] = masked
+	}
+	return
+}
+
+// restore returns txt with the placeholders of this round replaced
+// by the secrets they masked
+func (r *redactor) restore(txt string) string {
+	for ph, secret := range r.secrets {
+		txt = strings.ReplaceAll(txt, ph, secret)
+	}
+	return txt
+}
+
+// report prints what was masked
+func (r *redactor) report() {
+	if len(r.found) == 0 {
+		return
+	}
+	Pf("Redacted %d secrets before sending:\n", len(r.found))
+	for _, f := range r.found {
+		Pf("    %s:%d: %s -> %s\n", f.Source, f.Line, f.Kind, f.Placeholder)
+	}
+}
+
+// sendRedacted sends msgs, which the caller has already masked, and
+// the files in inFns, substituting the views that redactFiles returned.
+// It returns the response with the secrets restored, as well as the
+// response as it was received.
+func sendRedacted(llm Provider, r *redactor, sysmsg string, msgs []core.ChatMsg, inFns []string, outFls []core.FileLang, views map[string]string) (resp, received string, err error) {
+	defer Return(&err)
+	received, err = sendViews(llm, sysmsg, msgs, inFns, outFls, views)
+	Ck(err)
+	return r.restore(received), received, nil
+}
+
+// diffSummary returns a commit message for the staged changes.  The
+// provider reads the staged diff itself, so if the diff holds a
+// secret, the message is written locally from the changed file names
+// instead.
+func diffSummary(cfg *Config, llm Provider) (msg string, err error) {
+	defer Return(&err)
+	red, err := newRedactor(cfg)
+	Ck(err)
+	diff, err := runOk("git diff --staged", nil)
+	Ck(err)
+	if red.redact("staged diff", string(diff)) == string(diff) {
+		return llm.DiffSummary("--staged")
+	}
+	Pf("The staged diff contains %d secrets, so it isn't sent; writing the commit message locally\n", len(red.found))
+	stdout, err := runOk("git diff --staged --name-only -z", nil)
+	Ck(err)
+	var fns []string
+	for _, fn := range strings.Split(string(stdout), "\x00") {
+		if fn != "" {
+			fns = append(fns, fn)
+		}
+	}
+	subject := Spf("Update %d files", len(fns))
+	if len(fns) <= 3 {
+		subject = "Update " + strings.Join(fns, ", ")
+	}
+	stat, err := runOk("git diff --staged --stat", nil)
+	Ck(err)
+	msg = Spf("%s\n\n%s", subject, stat)
+	return
+}
@@ -0,0 +1,371 @@
+package x3
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/stevegt/envi"
+	. "github.com/stevegt/goadapt"
+)
+
+// attachRejected is the name of the prompt attachment that carries
+// the hunks the user rejected in the built-in reviewer
+const attachRejected = "rejected.diff"
+
+// difftoolBuiltin selects the built-in reviewer in the difftool
+// setting
+const difftoolBuiltin = "builtin"
+
+// fileDiff is the part of a unified diff that covers a single file
+type fileDiff struct {
+	// header holds the 'diff --git', 'index', '---', and '+++' lines
+	header []string
+	hunks  []*hunk
+}
+
+// hunk is a single hunk of a unified diff
+type hunk struct {
+	oldStart, oldCount int
+	newStart, newCount int
+	// section is the optional text after the closing '@@'
+	section string
+	// lines holds the hunk body, each line starting with ' ', '-',
+	// '+', or '\'
+	lines []string
+}
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@(.*)$`)
+
+// parseDiff parses the output of 'git diff'
+func parseDiff(txt string) (files []*fileDiff, err error) {
+	defer Return(&err)
+	var fd *fileDiff
+	var h *hunk
+	for _, line := range strings.Split(txt, "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff "):
+			fd = &fileDiff{header: []string{line}}
+			files = append(files, fd)
+			h = nil
+		case fd == nil:
+			continue
+		case strings.HasPrefix(line, "@@"):
+			m := hunkHeaderRe.FindStringSubmatch(line)
+			Assert(m != nil, "malformed hunk header: %s", line)
+			h = &hunk{section: m[5]}
+			h.oldStart, h.oldCount = atoiCount(m[1], m[2])
+			h.newStart, h.newCount = atoiCount(m[3], m[4])
+			fd.hunks = append(fd.hunks, h)
+		case h == nil:
+			fd.header = append(fd.header, line)
+		case line == "":
+			// trailing newline at end of the diff
+		default:
+			h.lines = append(h.lines, line)
+		}
+	}
+	return
+}
+
+// atoiCount converts the start and optional count of a hunk header
+func atoiCount(start, count string) (n, c int) {
+	n, _ = strconv.Atoi(start)
+	c = 1
+	if count != "" {
+		c, _ = strconv.Atoi(count)
+	}
+	return
+}
+
+// path returns the path of the file, taken from the '+++' header
+// or, for deleted files, the '---' header
+func (fd *fileDiff) path() string {
+	var path string
+	for _, line := range fd.header {
+		if strings.HasPrefix(line, "--- a/") {
+			path = strings.TrimPrefix(line, "--- a/")
+		}
+		if strings.HasPrefix(line, "+++ b/") {
+			path = strings.TrimPrefix(line, "+++ b/")
+		}
+	}
+	return path
+}
+
+// patch returns a patch for fd containing only the given hunks.
+// Overlapping hunks, such as the halves of a split hunk, are merged
+// because 'git apply' rejects them.
+func (fd *fileDiff) patch(hunks []*hunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, line := range fd.header {
+		b.WriteString(line + "\n")
+	}
+	for _, h := range mergeHunks(hunks) {
+		b.WriteString(h.String())
+	}
+	return b.String()
+}
+
+// mergeHunks merges hunks whose old line ranges overlap.  The hunks
+// must be in file order, and the overlapping lines must be context,
+// as is the case for the hunks returned by split.
+func mergeHunks(hunks []*hunk) (merged []*hunk) {
+	for _, h := range hunks {
+		if len(merged) > 0 {
+			prev := merged[len(merged)-1]
+			overlap := prev.oldStart + prev.oldCount - h.oldStart
+			if overlap > 0 && overlap <= len(h.lines) {
+				m := &hunk{
+					oldStart: prev.oldStart,
+					newStart: prev.newStart,
+					section:  prev.section,
+					lines:    append(append([]string{}, prev.lines...), h.lines[overlap:]...),
+				}
+				m.recount()
+				merged[len(merged)-1] = m
+				continue
+			}
+		}
+		merged = append(merged, h)
+	}
+	return
+}
+
+// recount sets the line counts of h from its lines
+func (h *hunk) recount() {
+	h.oldCount, h.newCount = 0, 0
+	for _, line := range h.lines {
+		switch line[0] {
+		case ' ':
+			h.oldCount++
+			h.newCount++
+		case '-':
+			h.oldCount++
+		case '+':
+			h.newCount++
+		}
+	}
+}
+
+// String returns the hunk in unified diff format
+func (h *hunk) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@%s\n", h.oldStart, h.oldCount, h.newStart, h.newCount, h.section)
+	for _, line := range h.lines {
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+// split splits a hunk into smaller hunks, one per run of changed
+// lines.  Context lines between two runs are shared by both hunks,
+// as in 'git add -p'.  It returns nil if the hunk can't be split.
+func (h *hunk) split() (hunks []*hunk) {
+	// find the runs of changed lines
+	type run struct{ start, end int }
+	var runs []run
+	for i := 0; i < len(h.lines); i++ {
+		if h.lines[i][0] == ' ' {
+			continue
+		}
+		r := run{start: i}
+		for i < len(h.lines) && h.lines[i][0] != ' ' {
+			i++
+		}
+		r.end = i
+		runs = append(runs, r)
+	}
+	if len(runs) < 2 {
+		return nil
+	}
+
+	// the old and new line numbers of each line
+	oldLn := make([]int, len(h.lines))
+	newLn := make([]int, len(h.lines))
+	o, n := h.oldStart, h.newStart
+	for i, line := range h.lines {
+		oldLn[i], newLn[i] = o, n
+		switch line[0] {
+		case ' ':
+			o++
+			n++
+		case '-':
+			o++
+		case '+':
+			n++
+		}
+	}
+
+	for i := range runs {
+		start := 0
+		if i > 0 {
+			start = runs[i-1].end
+		}
+		end := len(h.lines)
+		if i < len(runs)-1 {
+			end = runs[i+1].start
+		}
+		sub := &hunk{
+			oldStart: oldLn[start],
+			newStart: newLn[start],
+			lines:    append([]string{}, h.lines[start:end]...),
+		}
+		sub.recount()
+		hunks = append(hunks, sub)
+	}
+	return
+}
+
+// reviewChanges walks each hunk of the uncommitted changes in the
+// Out files and lets the user accept, reject, edit, or split it.
+// Rejected hunks are reverted in the working tree and attached to the
+// prompt file so GPT sees them in the next round.
+func reviewChanges(cfg *Config, promptFn string) (err error) {
+	defer Return(&err)
+	p, err := readPrompt(promptFn)
+	Ck(err)
+	_, outFns, err := expandPromptFiles(cfg, p)
+	Ck(err)
+	Assert(len(outFns) > 0, "no files match the Out patterns")
+	stdout, err := runOk("git diff -- "+quoteArgs(outFns...), nil)
+	Ck(err)
+	files, err := parseDiff(string(stdout))
+	Ck(err)
+	if len(files) == 0 {
+		Pf("No changes to review\n")
+		return
+	}
+
+	var revert, reapply, rejected strings.Builder
+	quit := false
+	for _, fd := range files {
+		var revertHunks, reapplyHunks, rejectedHunks []*hunk
+		queue := append([]*hunk{}, fd.hunks...)
+		for len(queue) > 0 {
+			h := queue[0]
+			queue = queue[1:]
+			if quit {
+				continue
+			}
+			Pf("\n%s\n%s", fd.path(), h)
+			choices := []string{"n", "e", "q"}
+			if len(h.split()) > 0 {
+				choices = append(choices, "s")
+			}
+			res, err := ask("Accept this hunk? (y=yes, n=reject, e=edit, s=split, q=accept rest)", "y", choices...)
+			Ck(err)
+			switch strings.ToLower(res) {
+			case "n":
+				revertHunks = append(revertHunks, h)
+				rejectedHunks = append(rejectedHunks, h)
+			case "e":
+				edited, err := editHunk(cfg, h)
+				Ck(err)
+				if edited == nil {
+					// an empty edit is an aborted one, as in
+					// 'git add -p'
+					Pf("The edited hunk is empty; leaving it unchanged\n")
+					queue = append([]*hunk{h}, queue...)
+					continue
+				}
+				revertHunks = append(revertHunks, h)
+				reapplyHunks = append(reapplyHunks, edited)
+			case "s":
+				queue = append(h.split(), queue...)
+			case "q":
+				quit = true
+			}
+		}
+		revert.WriteString(fd.patch(revertHunks))
+		reapply.WriteString(fd.patch(reapplyHunks))
+		rejected.WriteString(fd.patch(rejectedHunks))
+	}
+
+	// revert the rejected and edited hunks, then apply the edits
+	if revert.Len() > 0 {
+		_, stderr, rc, err := Run("git apply -R --recount", []byte(revert.String()))
+		Ck(err)
+		Assert(rc == 0, "git apply -R failed: %s", stderr)
+	}
+	if reapply.Len() > 0 {
+		_, stderr, rc, err := Run("git apply --recount", []byte(reapply.String()))
+		Ck(err)
+		Assert(rc == 0, "git apply of edited hunks failed: %s", stderr)
+	}
+
+	// tell GPT what the user rejected
+	p, err = readPrompt(promptFn)
+	Ck(err)
+	if rejected.Len() > 0 {
+		txt := "The following hunks of your last change were rejected by the user and have been reverted:\n\n" + rejected.String()
+		p.SetAttachment(attachRejected, txt)
+	} else {
+		p.RemoveAttachment(attachRejected)
+	}
+	err = writePrompt(promptFn, p)
+	Ck(err)
+	return
+}
+
+// editHunk opens h in an editor and returns the edited hunk, or nil
+// if the user deleted all of its lines, which aborts the edit
+func editHunk(cfg *Config, h *hunk) (edited *hunk, err error) {
+	defer Return(&err)
+	fh, err := os.CreateTemp("", "aidda-hunk-*.diff")
+	Ck(err)
+	fn := fh.Name()
+	defer os.Remove(fn)
+	_, err = fh.WriteString(Spf("# Edit the hunk below.  Lines starting with '+' will be kept,\n"+
+		"# and lines starting with '-' will be removed.  To drop a '+' line,\n"+
+		"# delete it.  To keep a '-' line, change the '-' to a ' '.\n"+
+		"# Lines starting with '#' are ignored.\n%s", h))
+	Ck(err)
+	err = fh.Close()
+	Ck(err)
+
+	editor := cfg.Editor
+	if editor == "" {
+		editor = envi.String("EDITOR", "vi")
+	}
+	rc, err := RunInteractive(Spf("%s %s", editor, fn))
+	Ck(err)
+	Assert(rc == 0, "editor failed")
+
+	buf, err := os.ReadFile(fn)
+	Ck(err)
+	edited = &hunk{}
+	lines := strings.Split(string(buf), "\n")
+	if lines[len(lines)-1] == "" {
+		// the newline at the end of the file
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "#"):
+			continue
+		case line == "":
+			// an empty context line whose leading space the
+			// editor stripped, as 'git add -p' assumes
+			edited.lines = append(edited.lines, " ")
+		case strings.HasPrefix(line, "@@"):
+			m := hunkHeaderRe.FindStringSubmatch(line)
+			Assert(m != nil, "malformed hunk header: %s", line)
+			edited.oldStart, _ = atoiCount(m[1], m[2])
+			edited.newStart, _ = atoiCount(m[3], m[4])
+			edited.section = m[5]
+		default:
+			edited.lines = append(edited.lines, line)
+		}
+	}
+	if len(edited.lines) == 0 {
+		return nil, nil
+	}
+	edited.recount()
+	return
+}
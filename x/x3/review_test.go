@@ -0,0 +1,182 @@
+package x3
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitInit creates a git repo in the current directory and commits
+// all files
+func gitInit(t *testing.T) {
+	t.Helper()
+	for _, v := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(v, "test")
+	}
+	for _, v := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(v, "test@example.com")
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "-A"},
+		{"commit", "-qm", "initial"},
+	} {
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+}
+
+func TestHunkSplit(t *testing.T) {
+	orig := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	chdirTemp(t, map[string]string{"a.txt": orig})
+	gitInit(t)
+	// two changes close enough together to land in a single hunk
+	changed := strings.Replace(strings.Replace(orig, "2\n", "two\n", 1), "6\n", "six\n", 1)
+	err := os.WriteFile("a.txt", []byte(changed), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("git", "diff", "--", "a.txt").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := parseDiff(string(out))
+	if err != nil {
+		t.Fatalf("parseDiff failed: %v", err)
+	}
+	if len(files) != 1 || files[0].path() != "a.txt" || len(files[0].hunks) != 1 {
+		t.Fatalf("Expected one hunk in a.txt, got: %#v", files)
+	}
+	subs := files[0].hunks[0].split()
+	if len(subs) != 2 {
+		t.Fatalf("Expected 2 hunks after split, got: %d", len(subs))
+	}
+	if !strings.Contains(subs[0].String(), "+two") || strings.Contains(subs[0].String(), "+six") {
+		t.Errorf("Unexpected first hunk: %s", subs[0])
+	}
+
+	// reverting just the second hunk keeps the first change
+	cmd := exec.Command("git", "apply", "-R", "--recount")
+	cmd.Stdin = strings.NewReader(files[0].patch(subs[1:]))
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git apply -R failed: %v\n%s", err, out)
+	}
+	got, _ := os.ReadFile("a.txt")
+	if string(got) != strings.Replace(orig, "2\n", "two\n", 1) {
+		t.Errorf("Expected only the second change to be reverted, got: %q", got)
+	}
+
+	// the halves of a split hunk overlap, so reverting both needs
+	// them to be merged
+	err = os.WriteFile("a.txt", []byte(changed), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command("git", "apply", "-R", "--recount")
+	cmd.Stdin = strings.NewReader(files[0].patch(subs))
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git apply -R failed: %v\n%s", err, out)
+	}
+	got, _ = os.ReadFile("a.txt")
+	if string(got) != orig {
+		t.Errorf("Expected both changes to be reverted, got: %q", got)
+	}
+}
+
+// stubAnswers makes ask read the given answers, one per question,
+// until the test is done
+func stubAnswers(t *testing.T, answers ...string) {
+	t.Helper()
+	orig := stdin
+	stdin = bufio.NewReader(strings.NewReader(strings.Join(answers, "\n") + "\n"))
+	t.Cleanup(func() { stdin = orig })
+}
+
+func TestReviewChanges(t *testing.T) {
+	orig := "1\n2\n\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n"
+	dir := chdirTemp(t, map[string]string{"a.txt": orig})
+	gitInit(t)
+	cfg := defaultConfig()
+	promptFn := ".aidda/prompt"
+	err := createPromptFile(cfg, promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two changes far enough apart to land in separate hunks; the
+	// first hunk has an empty context line
+	changed := strings.Replace(strings.Replace(orig, "2\n", "two\n", 1), "15\n", "fifteen\n", 1)
+	err = os.WriteFile("a.txt", []byte(changed), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the editor changes the first hunk, and strips the trailing
+	// space of the empty context line, as many editors do
+	script := filepath.Join(dir, "edit.sh")
+	err = os.WriteFile(script, []byte("#!/bin/sh\nsed -i -e 's/^+two$/+TWO/' -e 's/^ $//' \"$1\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Editor = "sh " + script
+	// edit the first hunk, reject the second
+	stubAnswers(t, "e", "n")
+	err = reviewChanges(cfg, promptFn)
+	if err != nil {
+		t.Fatalf("reviewChanges failed: %v", err)
+	}
+	got, _ := os.ReadFile("a.txt")
+	want := strings.Replace(orig, "2\n", "TWO\n", 1)
+	if string(got) != want {
+		t.Errorf("Expected the edit applied and the rejected hunk reverted, got: %q", got)
+	}
+	p, err := readPrompt(promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected, _ := p.Attachment(attachRejected)
+	if !strings.Contains(rejected, "+fifteen") || strings.Contains(rejected, "TWO") {
+		t.Errorf("Expected only the rejected hunk to be attached, got: %q", rejected)
+	}
+}
+
+func TestReviewEmptyEdit(t *testing.T) {
+	orig := "1\n2\n3\n"
+	dir := chdirTemp(t, map[string]string{"a.txt": orig})
+	gitInit(t)
+	cfg := defaultConfig()
+	promptFn := ".aidda/prompt"
+	err := createPromptFile(cfg, promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := strings.Replace(orig, "2\n", "two\n", 1)
+	err = os.WriteFile("a.txt", []byte(changed), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the editor deletes every line, which aborts the edit, so the
+	// hunk is asked about again and then rejected
+	script := filepath.Join(dir, "edit.sh")
+	err = os.WriteFile(script, []byte("#!/bin/sh\n: > \"$1\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Editor = "sh " + script
+	stubAnswers(t, "e", "n")
+	err = reviewChanges(cfg, promptFn)
+	if err != nil {
+		t.Fatalf("reviewChanges failed: %v", err)
+	}
+	got, _ := os.ReadFile("a.txt")
+	if string(got) != orig {
+		t.Errorf("Expected the hunk to be rejected after the aborted edit, got: %q", got)
+	}
+}
@@ -1,161 +1,258 @@
 package x3
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/shlex"
 	. "github.com/stevegt/goadapt"
 )
 
-// RunTee runs a command in the shell, with stdout and stderr tee'd to the terminal
-func RunTee(command string) (stdout, stderr []byte, rc int, err error) {
+// defaultMaxOutput is the default cap on the bytes captured from each
+// of stdout and stderr
+const defaultMaxOutput = 16 * 1024 * 1024
+
+// RunOpts are the options of RunContext.  The zero value runs the
+// command in the current directory with the current environment,
+// empty stdin, no timeout, and captured output.
+type RunOpts struct {
+	// Dir is the working directory of the command
+	Dir string
+	// Env holds "key=value" pairs added to the current environment
+	Env []string
+	// Stdin is written to the command's stdin
+	Stdin []byte
+	// Tee copies stdout and stderr to the terminal as well as
+	// capturing them
+	Tee bool
+	// Interactive connects the command to the terminal; nothing is
+	// captured
+	Interactive bool
+	// Timeout kills the command and any children it started if it
+	// runs longer than this; zero means no timeout
+	Timeout time.Duration
+	// MaxOutput caps the bytes captured from each of stdout and
+	// stderr; zero means defaultMaxOutput
+	MaxOutput int
+}
+
+// cappedBuffer is a writer that keeps the first max bytes written to
+// it and counts the rest.  It is safe to read while the command is
+// still writing to it.
+type cappedBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	max     int
+	dropped int
+}
+
+// Write implements io.Writer.  It never fails, so the command isn't
+// killed by a broken pipe when the cap is reached.
+func (b *cappedBuffer) Write(p []byte) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n = len(p)
+	room := max(b.max-b.buf.Len(), 0)
+	if room < len(p) {
+		b.dropped += len(p) - room
+		p = p[:room]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// Bytes returns a copy of the captured bytes, with a note if any were
+// dropped
+func (b *cappedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := bytes.Clone(b.buf.Bytes())
+	if b.dropped > 0 {
+		out = append(out, []byte(Spf("\n[aidda: %d bytes of output dropped]\n", b.dropped))...)
+	}
+	return out
+}
+
+// Result is the outcome of a command that was started.  A command
+// that fails, is killed, or times out still has a Result; only a
+// command that can't be started is an error.
+type Result struct {
+	Stdout []byte
+	Stderr []byte
+	// ExitCode is -1 if the command was killed by a signal
+	ExitCode int
+	// Signal is the name of the signal that killed the command, or
+	// "" if it exited
+	Signal   string
+	Duration time.Duration
+	// TimedOut is set if the command was killed because it ran past
+	// RunOpts.Timeout or the deadline of the context
+	TimedOut bool
+	// Canceled is set if the command was killed because the context
+	// was canceled, e.g. by ^C
+	Canceled bool
+}
+
+// Success returns true if the command exited with status 0
+func (res *Result) Success() bool {
+	return res.ExitCode == 0 && !res.TimedOut && !res.Canceled
+}
+
+// Status describes how the command ended
+func (res *Result) Status() string {
+	switch {
+	case res.TimedOut:
+		return Spf("timed out after %s", res.Duration.Round(time.Millisecond))
+	case res.Canceled:
+		return "interrupted"
+	case res.Signal != "":
+		return Spf("killed by signal: %s", res.Signal)
+	}
+	return Spf("exit status %d", res.ExitCode)
+}
+
+// RunContext runs a command and returns its Result.  The command is
+// killed, along with its process group, when ctx is done or
+// opts.Timeout expires.  The error is only set if the command could
+// not be run at all, e.g. because it was not found.
+func RunContext(ctx context.Context, command string, opts *RunOpts) (res *Result, err error) {
 	defer Return(&err)
+	if opts == nil {
+		opts = &RunOpts{}
+	}
 	// shlex the command to get the command and args
 	parts, err := shlex.Split(command)
 	Ck(err)
-	var args []string
-	var cmd string
-	if len(parts) > 1 {
-		cmd = parts[0]
-		args = parts[1:]
-	} else {
-		cmd = parts[0]
+	Assert(len(parts) > 0, "empty command")
+	if !opts.Interactive {
+		// the command runs in its own process group, so it won't
+		// see the terminal's ^C; kill it ourselves instead
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
 	}
 	// create the command
-	cobj := exec.Command(cmd, args...)
+	cobj := exec.CommandContext(ctx, parts[0], parts[1:]...)
+	cobj.Dir = opts.Dir
+	if len(opts.Env) > 0 {
+		cobj.Env = append(os.Environ(), opts.Env...)
+	}
 
-	// create a tee for stdout
-	stdoutPipe, err := cobj.StdoutPipe()
-	Ck(err)
-	stdoutTee := io.TeeReader(stdoutPipe, os.Stdout)
-	// create a tee for stderr
-	stderrPipe, err := cobj.StderrPipe()
-	Ck(err)
-	stderrTee := io.TeeReader(stderrPipe, os.Stderr)
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-	// read the stdout in a goroutine
-	go func() {
-		var err error
-		stdout, err = ioutil.ReadAll(stdoutTee)
-		Ck(err)
-		wg.Done()
-	}()
-
-	// read the stderr in a goroutine
-	go func() {
-		var err error
-		stderr, err = ioutil.ReadAll(stderrTee)
-		Ck(err)
-		wg.Done()
-	}()
-
-	// start the command
-	err = cobj.Start()
-	Ck(err)
-	// wait for the command to finish
-	err = cobj.Wait()
-	Ck(err)
-	// get the return code
-	rc = cobj.ProcessState.ExitCode()
-	// wait for the goroutines to finish
-	wg.Wait()
+	limit := opts.MaxOutput
+	if limit == 0 {
+		limit = defaultMaxOutput
+	}
+	outBuf := &cappedBuffer{max: limit}
+	errBuf := &cappedBuffer{max: limit}
+	if opts.Interactive {
+		// connect the stdio to the terminal; the command stays in
+		// our process group so it can read from the terminal
+		cobj.Stdin = os.Stdin
+		cobj.Stdout = os.Stdout
+		cobj.Stderr = os.Stderr
+	} else {
+		cobj.Stdin = bytes.NewReader(opts.Stdin)
+		cobj.Stdout = outBuf
+		cobj.Stderr = errBuf
+		if opts.Tee {
+			cobj.Stdout = io.MultiWriter(outBuf, os.Stdout)
+			cobj.Stderr = io.MultiWriter(errBuf, os.Stderr)
+		}
+		// kill the whole process group, so that e.g. the test
+		// binaries started by 'go test' die with it
+		setProcessGroup(cobj)
+	}
+	// don't wait forever for children that hold the output open
+	cobj.WaitDelay = time.Second
+
+	start := time.Now()
+	err = cobj.Run()
+	res = &Result{
+		Stdout:   outBuf.Bytes(),
+		Stderr:   errBuf.Bytes(),
+		Duration: time.Since(start),
+	}
+	if cobj.ProcessState == nil {
+		// the command never started
+		Ck(err, command)
+	}
+	// a non-zero exit, or children left holding the output open
+	// after the command exited, are part of the result
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) || errors.Is(err, exec.ErrWaitDelay) {
+		err = nil
+	}
+	Ck(err, command)
+	res.ExitCode = cobj.ProcessState.ExitCode()
+	if !cobj.ProcessState.Exited() {
+		res.Signal = strings.TrimPrefix(cobj.ProcessState.String(), "signal: ")
+	}
+	res.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+	res.Canceled = errors.Is(ctx.Err(), context.Canceled)
 	return
 }
 
-// Run runs a command in the shell, returning stdout, stderr, and rc
-func Run(command string, stdin []byte) (stdout, stderr []byte, rc int, err error) {
+// quoteArgs quotes each of args so that RunContext passes it to the
+// command as a single argument, even if it contains spaces or quotes,
+// and joins them with spaces
+func quoteArgs(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// runOk runs a command that is expected to succeed and returns its
+// stdout.  Unlike Run, a non-zero exit is an error, which includes
+// the command's stderr.
+func runOk(command string, stdin []byte) (stdout []byte, err error) {
 	defer Return(&err)
-	// shlex the command to get the command and args
-	parts, err := shlex.Split(command)
+	res, err := RunContext(context.Background(), command, &RunOpts{Stdin: stdin})
 	Ck(err)
-	var args []string
-	var cmd string
-	if len(parts) > 1 {
-		cmd = parts[0]
-		args = parts[1:]
-	} else {
-		cmd = parts[0]
+	Assert(res.Success(), "%s: %s: %s", command, res.Status(), strings.TrimSpace(string(res.Stderr)))
+	return res.Stdout, nil
+}
+
+// RunTee runs a command in the shell, with stdout and stderr tee'd to
+// the terminal.  A non-zero exit is reported in rc, not err.
+func RunTee(command string) (stdout, stderr []byte, rc int, err error) {
+	res, err := RunContext(context.Background(), command, &RunOpts{Tee: true})
+	if err != nil {
+		return
 	}
-	// create the command
-	cobj := exec.Command(cmd, args...)
-	// create a pipe for stdin
-	stdinPipe, err := cobj.StdinPipe()
-	Ck(err)
-	// create a pipe for stdout
-	stdoutPipe, err := cobj.StdoutPipe()
-	Ck(err)
-	// create a pipe for stderr
-	stderrPipe, err := cobj.StderrPipe()
-	Ck(err)
-	// start the command
-	err = cobj.Start()
-	Ck(err)
-	wg := sync.WaitGroup{}
-	wg.Add(3)
-	// pipe stdin to the command in a goroutine
-	go func() {
-		var err error
-		_, err = stdinPipe.Write(stdin)
-		Ck(err)
-		stdinPipe.Close()
-		wg.Done()
-	}()
-	// read the stdout in a goroutine
-	go func() {
-		var err error
-		stdout, err = ioutil.ReadAll(stdoutPipe)
-		Ck(err)
-		wg.Done()
-	}()
-	// read the stderr in a goroutine
-	go func() {
-		var err error
-		stderr, err = ioutil.ReadAll(stderrPipe)
-		Ck(err)
-		wg.Done()
-	}()
-	// wait for the command to finish
-	err = cobj.Wait()
-	Ck(err)
-	// get the return code
-	rc = cobj.ProcessState.ExitCode()
-	// wait for the goroutines to finish
-	wg.Wait()
-	return
+	return res.Stdout, res.Stderr, res.ExitCode, nil
+}
+
+// Run runs a command in the shell, returning stdout, stderr, and rc.
+// A non-zero exit is reported in rc, not err.
+func Run(command string, stdin []byte) (stdout, stderr []byte, rc int, err error) {
+	res, err := RunContext(context.Background(), command, &RunOpts{Stdin: stdin})
+	if err != nil {
+		return
+	}
+	return res.Stdout, res.Stderr, res.ExitCode, nil
 }
 
-// RunInteractive runs a command in the shell, with stdio connected to the terminal
+// RunInteractive runs a command in the shell, with stdio connected to
+// the terminal.  A non-zero exit is reported in rc, not err.
 func RunInteractive(command string) (rc int, err error) {
-	defer Return(&err)
-	// shlex the command to get the command and args
-	parts, err := shlex.Split(command)
-	Ck(err)
-	var args []string
-	var cmd string
-	if len(parts) > 1 {
-		cmd = parts[0]
-		args = parts[1:]
-	} else {
-		cmd = parts[0]
+	res, err := RunContext(context.Background(), command, &RunOpts{Interactive: true})
+	if err != nil {
+		return
 	}
-	// create the command
-	cobj := exec.Command(cmd, args...)
-	// connect the stdio to the terminal
-	cobj.Stdin = os.Stdin
-	cobj.Stdout = os.Stdout
-	cobj.Stderr = os.Stderr
-	// start the command
-	err = cobj.Start()
-	Ck(err)
-	// wait for the command to finish
-	err = cobj.Wait()
-	Ck(err)
-	// get the return code
-	rc = cobj.ProcessState.ExitCode()
-	return
+	return res.ExitCode, nil
 }
@@ -0,0 +1,152 @@
+package x3
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+	"github.com/stevegt/grokker/v3/core"
+)
+
+// attachRejectedWrites is the name of the prompt attachment that
+// lists the files GPT was not allowed to write in the last round
+const attachRejectedWrites = "rejected-writes.txt"
+
+// protectedDirs are the directories GPT may never write into
+var protectedDirs = []string{".git", ".aidda"}
+
+// rejectedWrite is a file GPT was not allowed to write, and why
+type rejectedWrite struct {
+	Path   string
+	Reason string
+}
+
+// writePathRefusal returns why GPT may not write fn, a path relative
+// to the top of the tree, or "" if it may.  Absolute paths, '..'
+// traversal, .git and .aidda, and paths that go through a symlink to
+// outside the tree are all refused.
+func writePathRefusal(fn string) (reason string, err error) {
+	defer Return(&err)
+	if fn == "" || filepath.Clean(fn) == "." {
+		return "empty path", nil
+	}
+	if filepath.IsAbs(fn) {
+		return "absolute path", nil
+	}
+	for _, part := range strings.Split(filepath.ToSlash(fn), "/") {
+		if part == ".." {
+			return "'..' in path", nil
+		}
+		if contains(protectedDirs, part) {
+			return Spf("inside %s", part), nil
+		}
+	}
+
+	// resolve symlinks in the longest part of the path that exists
+	root, err := os.Getwd()
+	Ck(err)
+	root, err = filepath.EvalSymlinks(root)
+	Ck(err)
+	existing := filepath.Clean(fn)
+	for {
+		_, err = os.Lstat(existing)
+		if err == nil || !os.IsNotExist(err) {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	Ck(err)
+	resolved, err := filepath.EvalSymlinks(existing)
+	if os.IsNotExist(err) {
+		// writing through it could create a file anywhere
+		return "dangling symlink", nil
+	}
+	Ck(err)
+	resolved, err = filepath.Abs(resolved)
+	Ck(err)
+	rel, err := filepath.Rel(root, resolved)
+	Ck(err)
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "symlink to outside the tree", nil
+	}
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if contains(protectedDirs, part) {
+			return Spf("symlink into %s", part), nil
+		}
+	}
+	return "", nil
+}
+
+// filterWritePaths splits fns into the ones GPT may write and the
+// ones it may not
+func filterWritePaths(fns []string) (allowed []string, rejected []rejectedWrite, err error) {
+	defer Return(&err)
+	for _, fn := range fns {
+		reason, err := writePathRefusal(fn)
+		Ck(err)
+		if reason != "" {
+			rejected = append(rejected, rejectedWrite{Path: fn, Reason: reason})
+			continue
+		}
+		allowed = append(allowed, fn)
+	}
+	return
+}
+
+// fileHeaderRe matches the header of each file in a response
+var fileHeaderRe = regexp.MustCompile(`(?im)^File:\s*(\S+)\s*$`)
+
+// undeclaredFiles returns the files in resp that aren't in outFls;
+// they are never extracted
+func undeclaredFiles(resp string, outFls []core.FileLang) (rejected []rejectedWrite) {
+	seen := make(map[string]bool)
+	for _, fl := range outFls {
+		seen[fl.File] = true
+	}
+	for _, m := range fileHeaderRe.FindAllStringSubmatch(resp, -1) {
+		if seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		rejected = append(rejected, rejectedWrite{Path: m[1], Reason: "not a declared Out file"})
+	}
+	return
+}
+
+// rejectedWritesText describes rejected for the user and GPT
+func rejectedWritesText(rejected []rejectedWrite) string {
+	var b strings.Builder
+	b.WriteString("The following files were not written, because writing them is not allowed:\n")
+	for _, r := range rejected {
+		Fpf(&b, "    %s: %s\n", r.Path, r.Reason)
+	}
+	return b.String()
+}
+
+// reportRejectedWrites prints rejected and attaches it to the prompt
+// file that p was read from, if any, so GPT sees it in the next
+// round.  If nothing was rejected, any old report is removed.
+func reportRejectedWrites(p *Prompt, rejected []rejectedWrite) (err error) {
+	defer Return(&err)
+	if len(rejected) > 0 {
+		Pf("%s", rejectedWritesText(rejected))
+	}
+	if p.path == "" {
+		return
+	}
+	if len(rejected) > 0 {
+		err = setPromptAttachment(p.path, attachRejectedWrites, rejectedWritesText(rejected))
+		Ck(err)
+		return
+	}
+	current, err := readPrompt(p.path)
+	Ck(err)
+	if _, ok := current.Attachment(attachRejectedWrites); ok {
+		current.RemoveAttachment(attachRejectedWrites)
+		err = writePrompt(p.path, current)
+		Ck(err)
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package x3
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stevegt/grokker/v3/core"
+)
+
+func TestWritePathRefusal(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	outside := t.TempDir()
+	err := os.Symlink(outside, "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(".aidda", "hidden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(filepath.Join(outside, "gone"), "dangling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		fn     string
+		reason string
+	}{
+		{"a.go", ""},
+		{"sub/new.go", ""},
+		{"", "empty path"},
+		{filepath.Join(outside, "x.go"), "absolute path"},
+		{"../x.go", "'..' in path"},
+		{"sub/../../x.go", "'..' in path"},
+		{".git/config", "inside .git"},
+		{"sub/.aidda/x", "inside .aidda"},
+		{"out/x.go", "symlink to outside the tree"},
+		{"out/sub/x.go", "symlink to outside the tree"},
+		{"hidden/ignore", "symlink into .aidda"},
+		{"dangling", "dangling symlink"},
+		{"dangling/x.go", "dangling symlink"},
+	}
+	for _, c := range cases {
+		reason, err := writePathRefusal(c.fn)
+		if err != nil {
+			t.Fatalf("%q: %v", c.fn, err)
+		}
+		if reason != c.reason {
+			t.Errorf("%q: expected %q, got %q", c.fn, c.reason, reason)
+		}
+	}
+
+	allowed, rejected, err := filterWritePaths([]string{"a.go", "../x.go", "b.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(allowed, " ") != "a.go b.go" || len(rejected) != 1 || rejected[0].Path != "../x.go" {
+		t.Fatalf("unexpected split: %v %v", allowed, rejected)
+	}
+}
+
+func TestUndeclaredFiles(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	outFls := []core.FileLang{{File: "a.go", Language: "go"}}
+	resp := fileResponse("a.go", "go", "package a // new\n") + fileResponse(".git/hooks/pre-commit", "sh", "echo hi\n")
+	staged, rejected, err := stagePending(outFls, resp, nil, "")
+	if err != nil {
+		t.Fatalf("stagePending failed: %v", err)
+	}
+	if strings.Join(staged, " ") != "a.go" {
+		t.Fatalf("expected only a.go to be staged, got %v", staged)
+	}
+	if len(rejected) != 1 || rejected[0].Path != ".git/hooks/pre-commit" {
+		t.Fatalf("expected the hook to be rejected, got %v", rejected)
+	}
+
+	// the report is attached to the prompt file, and removed once
+	// nothing is rejected
+	p := &Prompt{In: []string{"*.go"}, Out: []string{"a.go"}, Txt: "do it", path: "prompt"}
+	err = writePrompt(p.path, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reportRejectedWrites(p, rejected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readPrompt(p.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, ok := got.Attachment(attachRejectedWrites)
+	if !ok || !strings.Contains(body, ".git/hooks/pre-commit: not a declared Out file") {
+		t.Fatalf("expected a rejected-writes attachment, got %q", body)
+	}
+	err = reportRejectedWrites(p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = readPrompt(p.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.Attachment(attachRejectedWrites); ok {
+		t.Fatalf("expected the rejected-writes attachment to be removed")
+	}
+}
@@ -0,0 +1,143 @@
+package x3
+
+import (
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+)
+
+// trailerRound is the git trailer that marks a commit as containing
+// the response of one or more prompt rounds; its values are the
+// round IDs in .aidda/history
+const trailerRound = "Aidda-Round"
+
+// trailer is a single git trailer
+type trailer struct {
+	Key   string
+	Value string
+}
+
+// addTrailers appends trailers to msg as a single trailer block
+func addTrailers(msg string, trailers []trailer) string {
+	if len(trailers) == 0 {
+		return msg
+	}
+	msg = strings.TrimRight(msg, "\n") + "\n\n"
+	for _, t := range trailers {
+		msg += Spf("%s: %s\n", t.Key, t.Value)
+	}
+	return msg
+}
+
+// aiCommits returns the hashes of the commits holding the last n
+// prompt rounds, newest first.  A commit holds one round for each
+// value of its round trailer.  It returns an error if any of them is
+// not an AI-applied commit, or if the rounds end partway through a
+// commit.
+func aiCommits(n int) (hashes []string, err error) {
+	defer Return(&err)
+	Assert(n > 0, "n must be positive")
+	// each commit holds at least one round
+	format := Spf("--format=%%H%%x09%%P%%x09%%(trailers:key=%s,valueonly,separator=%%x2C)", trailerRound)
+	stdout, err := runOk(Spf("git log -n %d %s", n, format), nil)
+	Ck(err)
+	total, last := 0, 0
+	for _, line := range strings.Split(strings.TrimRight(string(stdout), "\n"), "\n") {
+		if line == "" || total >= n {
+			break
+		}
+		fields := strings.SplitN(line, "\t", 3)
+		Assert(len(fields) == 3, "unexpected git log output: %s", line)
+		hash, parents, rounds := fields[0], fields[1], splitList(fields[2])
+		Assert(!strings.Contains(parents, " "), "commit %s is a merge; refusing to undo", hash)
+		Assert(len(rounds) > 0, "commit %s was not applied by aidda; refusing to undo", hash)
+		hashes = append(hashes, hash)
+		last = len(rounds)
+		total += last
+	}
+	Assert(total >= n, "there are fewer than %d rounds", n)
+	if total > n {
+		try := Spf("%d", total)
+		if total-last > 0 {
+			try = Spf("%d or %d", total-last, total)
+		}
+		Assert(false, "commit %s holds %d rounds, so undo can't stop at %d rounds; undo %s", hashes[len(hashes)-1], last, n, try)
+	}
+	return
+}
+
+// undoRounds reverts the commits holding the last n prompt rounds
+// with a single new commit; see aiCommits.  It refuses if any of them
+// was made by a human or if the working tree is dirty.  It returns
+// the reverted commits, newest first.
+func undoRounds(n int) (hashes []string, err error) {
+	defer Return(&err)
+	aside, err := ensureClean()
+	Ck(err)
+	defer restoreAside(aside, &err)
+	hashes, err = aiCommits(n)
+	Ck(err)
+
+	_, err = runOk(Spf("git revert --no-commit HEAD~%d..HEAD", len(hashes)), nil)
+	Ck(err)
+	msg := Spf("Undo the last %d aidda rounds\n\nThis reverts:\n", n)
+	for _, hash := range hashes {
+		msg += Spf("    %s\n", hash)
+	}
+	_, err = runOk("git commit -F-", []byte(msg))
+	Ck(err)
+	return
+}
+
+// stageReverted stages the files changed by the reverted commits,
+// as they were before the revert, as a pending change so that the
+// user can re-apply them with 'apply'.  Deleted files are skipped, as
+// are aidda's own files in .aidda, which apply never writes.
+func stageReverted(hashes []string) (staged []string, err error) {
+	defer Return(&err)
+	newest := hashes[0]
+	oldest := hashes[len(hashes)-1]
+	// --relative gives paths relative to the current directory, and
+	// leaves out files above it, which apply can't write anyway
+	stdout, err := runOk(Spf("git diff --name-only -z --relative --diff-filter=d %s~1 %s", oldest, newest), nil)
+	Ck(err)
+	files := make(map[string][]byte)
+	for _, fn := range strings.Split(string(stdout), "\x00") {
+		if fn == "" || inProtectedDir(fn) != "" {
+			continue
+		}
+		buf, err := runOk("git show "+quoteArgs(newest+":./"+fn), nil)
+		Ck(err)
+		files[fn] = buf
+	}
+	staged, err = stagePendingFiles(files, "")
+	Ck(err)
+	return
+}
+
+// undoInteractive undoes the last n AI rounds, then offers to keep
+// the reverted change as a pending change
+func undoInteractive(n int) (err error) {
+	defer Return(&err)
+	hashes, err := aiCommits(n)
+	Ck(err)
+	for _, hash := range hashes {
+		stdout, err := runOk(Spf("git log -n 1 --format=%%h%%x20%%s %s", hash), nil)
+		Ck(err)
+		Pf("    %s", stdout)
+	}
+	res, err := ask(Spf("Revert these %d commits, holding %d rounds?", len(hashes), n), "n", "y")
+	Ck(err)
+	if strings.ToLower(res) != "y" {
+		return
+	}
+	hashes, err = undoRounds(n)
+	Ck(err)
+	res, err = ask("Keep the reverted change as a pending change?", "n", "y")
+	Ck(err)
+	if strings.ToLower(res) == "y" {
+		_, err = stageReverted(hashes)
+		Ck(err)
+	}
+	return
+}
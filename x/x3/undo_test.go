@@ -0,0 +1,162 @@
+package x3
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// gitCommit commits all changes with the given message
+func gitCommit(t *testing.T, msg string) {
+	t.Helper()
+	out, err := exec.Command("git", "add", "-A").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git add failed: %v\n%s", err, out)
+	}
+	cmd := exec.Command("git", "commit", "-qF-")
+	cmd.Stdin = strings.NewReader(msg)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git commit failed: %v\n%s", err, out)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	gitInit(t)
+
+	// two AI rounds
+	// each round's commit includes the prompt file
+	os.WriteFile("a.go", []byte("package a // round 1\n"), 0644)
+	os.WriteFile(".aidda/prompt", []byte("prompt 1\n"), 0644)
+	gitCommit(t, addTrailers("round 1", []trailer{{trailerRound, "r1"}}))
+	os.WriteFile("a.go", []byte("package a // round 2\n"), 0644)
+	os.WriteFile(".aidda/prompt", []byte("prompt 2\n"), 0644)
+	gitCommit(t, addTrailers("round 2", []trailer{{trailerRound, "r2"}}))
+
+	hashes, err := aiCommits(2)
+	if err != nil || len(hashes) != 2 {
+		t.Fatalf("Expected 2 AI commits, got: %v %v", hashes, err)
+	}
+	// the initial commit was made by a human
+	_, err = aiCommits(3)
+	if err == nil {
+		t.Errorf("Expected aiCommits to refuse human commits")
+	}
+
+	// the prompt file changes after every round
+	os.WriteFile(".aidda/prompt", []byte("next prompt\n"), 0644)
+	hashes, err = undoRounds(2)
+	if err != nil {
+		t.Fatalf("undoRounds failed: %v", err)
+	}
+	got, _ := os.ReadFile("a.go")
+	if string(got) != "package a\n" {
+		t.Errorf("Expected a.go to be reverted, got: %q", got)
+	}
+	got, _ = os.ReadFile(".aidda/prompt")
+	if string(got) != "next prompt\n" {
+		t.Errorf("Expected the prompt file to be kept, got: %q", got)
+	}
+	// the undo commit is not an AI commit, so it can't be undone
+	_, err = aiCommits(1)
+	if err == nil {
+		t.Errorf("Expected aiCommits to refuse the undo commit")
+	}
+
+	// the reverted change can be kept as a pending change
+	staged, err := stageReverted(hashes)
+	if err != nil {
+		t.Fatalf("stageReverted failed: %v", err)
+	}
+	if len(staged) != 1 || staged[0] != "a.go" {
+		t.Errorf("Expected a.go to be staged, got: %v", staged)
+	}
+	_, _, err = applyPending(false)
+	if err != nil {
+		t.Fatalf("applyPending failed: %v", err)
+	}
+	got, _ = os.ReadFile("a.go")
+	if string(got) != "package a // round 2\n" {
+		t.Errorf("Expected round 2 to be re-applied, got: %q", got)
+	}
+}
+
+func TestUndoSubdir(t *testing.T) {
+	// aidda runs in a subdirectory of the repo, and a file name has a
+	// space in it
+	chdirTemp(t, map[string]string{
+		"sub/a.go":          "package a\n",
+		"sub/b c.go":        "package a\n",
+		"sub/.aidda/ignore": ".git\n",
+	})
+	gitInit(t)
+	err := os.Chdir("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile("a.go", []byte("package a // round 1\n"), 0644)
+	os.WriteFile("b c.go", []byte("package a // round 1\n"), 0644)
+	os.WriteFile(".aidda/prompt", []byte("prompt 1\n"), 0644)
+	gitCommit(t, addTrailers("round 1", []trailer{{trailerRound, "r1"}}))
+
+	os.WriteFile(".aidda/prompt", []byte("next prompt\n"), 0644)
+	hashes, err := undoRounds(1)
+	if err != nil {
+		t.Fatalf("undoRounds failed: %v", err)
+	}
+	staged, err := stageReverted(hashes)
+	if err != nil {
+		t.Fatalf("stageReverted failed: %v", err)
+	}
+	if strings.Join(staged, ",") != "a.go,b c.go" {
+		t.Errorf("Expected a.go and b c.go to be staged, got: %q", staged)
+	}
+	_, _, err = applyPending(false)
+	if err != nil {
+		t.Fatalf("applyPending failed: %v", err)
+	}
+	for _, fn := range []string{"a.go", "b c.go"} {
+		got, _ := os.ReadFile(fn)
+		if string(got) != "package a // round 1\n" {
+			t.Errorf("Expected round 1 to be re-applied to %s, got: %q", fn, got)
+		}
+	}
+	if _, err := os.Stat("sub"); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written under sub/sub, got: %v", err)
+	}
+}
+
+func TestUndoCountsRounds(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	gitInit(t)
+	// two rounds applied together, then one on its own
+	os.WriteFile("a.go", []byte("package a // rounds 1 and 2\n"), 0644)
+	gitCommit(t, addTrailers("rounds 1 and 2", []trailer{{trailerRound, "r1"}, {trailerRound, "r2"}}))
+	os.WriteFile("a.go", []byte("package a // round 3\n"), 0644)
+	gitCommit(t, addTrailers("round 3", []trailer{{trailerRound, "r3"}}))
+
+	hashes, err := aiCommits(3)
+	if err != nil || len(hashes) != 2 {
+		t.Fatalf("Expected 3 rounds in 2 commits, got: %v %v", hashes, err)
+	}
+	// the rounds can't be split at a commit
+	_, err = aiCommits(2)
+	if err == nil || !strings.Contains(err.Error(), "holds 2 rounds, so undo can't stop at 2 rounds; undo 1 or 3") {
+		t.Errorf("Expected aiCommits to refuse to split a commit, got: %v", err)
+	}
+	_, err = aiCommits(4)
+	if err == nil || !strings.Contains(err.Error(), "not applied by aidda") {
+		t.Errorf("Expected aiCommits to refuse the human commit, got: %v", err)
+	}
+
+	_, err = undoRounds(3)
+	if err != nil {
+		t.Fatalf("undoRounds failed: %v", err)
+	}
+	got, _ := os.ReadFile("a.go")
+	if string(got) != "package a\n" {
+		t.Errorf("Expected all 3 rounds to be reverted, got: %q", got)
+	}
+}
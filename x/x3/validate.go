@@ -0,0 +1,130 @@
+package x3
+
+import (
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	. "github.com/stevegt/goadapt"
+	"golang.org/x/tools/go/packages"
+)
+
+// errPosRe splits the position of a packages.Error into the file and
+// the line and column
+var errPosRe = regexp.MustCompile(`^(.+?)((?::\d+){1,2})$`)
+
+// validateStaged parses each staged Go file and type-checks it in its
+// package, with the staged files in place of the ones in the working
+// tree.  It returns the errors the staged files introduce into those
+// packages, including in files a staged change broke without being
+// staged itself, one per line, or "" if there are none.
+func validateStaged(staged []string) (report string, err error) {
+	defer Return(&err)
+	cwd, err := os.Getwd()
+	Ck(err)
+	overlay := make(map[string][]byte)
+	var errs []string
+	for _, fn := range staged {
+		if !strings.HasSuffix(fn, ".go") {
+			continue
+		}
+		buf, err := os.ReadFile(filepath.Join(pendingFilesDir(), fn))
+		Ck(err)
+		overlay[filepath.Join(cwd, fn)] = buf
+		_, err = parser.ParseFile(token.NewFileSet(), fn, buf, parser.AllErrors|parser.SkipObjectResolution)
+		if list, ok := err.(scanner.ErrorList); ok {
+			for _, e := range list {
+				errs = append(errs, e.Error())
+			}
+		} else {
+			Ck(err)
+		}
+	}
+	if len(overlay) == 0 || len(errs) > 0 {
+		// type errors in a file that doesn't parse are just noise
+		return strings.Join(errs, "\n"), nil
+	}
+
+	// type-check the packages the staged files are in
+	var dirs []string
+	for path := range overlay {
+		dir := "./" + filepath.ToSlash(filepath.Dir(strings.TrimPrefix(path, cwd+string(filepath.Separator))))
+		if !contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	found, err := typeErrors(cwd, dirs, overlay)
+	if err != nil {
+		// e.g. there is no go.mod; the parse is all we can check
+		Pf("Not type-checking the returned files: %v\n", err)
+		return "", nil
+	}
+	// errors that are already in the working tree aren't GPT's to
+	// fix
+	before, err := typeErrors(cwd, dirs, nil)
+	if err != nil {
+		before = nil
+	}
+	old := make(map[string]bool)
+	for _, e := range before {
+		old[e.key] = true
+	}
+	for _, e := range found {
+		if !old[e.key] {
+			errs = append(errs, e.msg)
+		}
+	}
+	return strings.Join(errs, "\n"), nil
+}
+
+// typeError is an error found by typeErrors
+type typeError struct {
+	// key identifies the error by file and message, but not line,
+	// so it matches the same error after lines move
+	key string
+	msg string
+}
+
+// typeErrors parses and type-checks the packages in dirs, with the
+// overlay in place of the files in the working tree, and returns
+// their errors, each by its path relative to cwd where it has one
+func typeErrors(cwd string, dirs []string, overlay map[string][]byte) (errs []typeError, err error) {
+	defer Return(&err)
+	// check the dependencies from source, as any overlay forces
+	// anyway; without one, the test variants' imports have no export
+	// data and packages.Load exits the process
+	cfg := &packages.Config{
+		Mode:    packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedTypes | packages.NeedSyntax | packages.NeedDeps,
+		Tests:   true,
+		Overlay: overlay,
+	}
+	pkgs, err := packages.Load(cfg, dirs...)
+	Ck(err)
+	seen := make(map[string]bool)
+	for _, pkg := range pkgs {
+		for _, e := range pkg.Errors {
+			if e.Kind != packages.ParseError && e.Kind != packages.TypeError {
+				continue
+			}
+			te := typeError{key: e.Msg, msg: e.Error()}
+			m := errPosRe.FindStringSubmatch(e.Pos)
+			if m != nil {
+				rel, err := filepath.Rel(cwd, m[1])
+				Ck(err)
+				te = typeError{key: Spf("%s: %s", rel, e.Msg), msg: Spf("%s%s: %s", rel, m[2], e.Msg)}
+			}
+			// test variants of a package repeat its errors
+			if !seen[te.msg] {
+				seen[te.msg] = true
+				errs = append(errs, te)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package x3
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateStaged(t *testing.T) {
+	t.Setenv("GOWORK", "off")
+	chdirTemp(t, map[string]string{
+		"go.mod":      "module example.com/m\n\ngo 1.21\n",
+		"a/a.go":      "package a\n\nfunc A() int { return 1 }\n",
+		"a/b.go":      "package a\n\nvar B = A()\n",
+		"a/a_test.go": "package a\n",
+	})
+	syntaxErr := fileResponse("a/a.go", "go", "package a\n\nfunc A() int { return 1\n")
+	typeErr := fileResponse("a/a.go", "go", "package a\n\nfunc A() string { return 1 }\n")
+	good := fileResponse("a/a.go", "go", "package a\n\nfunc A() int { return 2 }\n")
+	llm := &scriptedProvider{responses: []string{syntaxErr, typeErr, good}}
+	p := &Prompt{In: []string{"a/"}, Out: []string{"a/a.go"}, Txt: "return 2"}
+	rec, err := getChanges(defaultConfig(), llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	if len(llm.requests) != 3 || len(rec.Corrections) != 2 || rec.Response != good {
+		t.Fatalf("expected two corrective rounds, got %d requests and %#v", len(llm.requests), rec.Corrections)
+	}
+	if !strings.HasPrefix(rec.Corrections[0].Errors, "a/a.go:3:") {
+		t.Errorf("expected a syntax error in a/a.go, got %q", rec.Corrections[0].Errors)
+	}
+	if !strings.Contains(rec.Corrections[1].Errors, "a/a.go:3:") || strings.Contains(rec.Corrections[1].Errors, "b.go") {
+		t.Errorf("expected a type error in a/a.go only, got %q", rec.Corrections[1].Errors)
+	}
+	// the errors are sent back along with the broken response
+	last := llm.requests[2].msgs
+	if len(last) != 5 || last[3].Txt != typeErr || !strings.Contains(last[4].Txt, rec.Corrections[1].Errors) {
+		t.Errorf("unexpected corrective messages: %#v", last)
+	}
+	_, _, err = applyPending(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile("a/a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "return 2") {
+		t.Errorf("expected the corrected file, got %q", got)
+	}
+
+	// with no corrective rounds, the broken file is staged as is
+	cfg := defaultConfig()
+	cfg.FixRounds = 0
+	llm = &scriptedProvider{responses: []string{syntaxErr}}
+	rec, err = getChanges(cfg, llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	if len(llm.requests) != 1 || len(rec.Corrections) != 0 {
+		t.Errorf("expected no corrective rounds, got %d requests", len(llm.requests))
+	}
+	manifest, err := readPending()
+	if err != nil || manifest == nil || len(manifest.Files) != 1 {
+		t.Errorf("expected the broken file to be staged, got %#v %v", manifest, err)
+	}
+}
+
+func TestValidateStagedBreaksOthers(t *testing.T) {
+	t.Setenv("GOWORK", "off")
+	chdirTemp(t, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.21\n",
+		"a/a.go": "package a\n\nfunc A() int { return 1 }\n",
+		"a/b.go": "package a\n\nvar B = A()\n",
+	})
+	// renaming A breaks its caller in b.go, which isn't staged
+	renamed := fileResponse("a/a.go", "go", "package a\n\nfunc A2() int { return 1 }\n")
+	good := fileResponse("a/a.go", "go", "package a\n\nfunc A() int { return 2 }\n")
+	llm := &scriptedProvider{responses: []string{renamed, good}}
+	p := &Prompt{In: []string{"a/"}, Out: []string{"a/a.go"}, Txt: "return 2"}
+	rec, err := getChanges(defaultConfig(), llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	if len(rec.Corrections) != 1 {
+		t.Fatalf("expected one corrective round, got %#v", rec.Corrections)
+	}
+	if errs := rec.Corrections[0].Errors; !strings.Contains(errs, "a/b.go:3:") || !strings.Contains(errs, "undefined: A") {
+		t.Errorf("expected the broken caller in a/b.go, got %q", errs)
+	}
+}
+
+func TestValidateStagedExistingErrors(t *testing.T) {
+	t.Setenv("GOWORK", "off")
+	chdirTemp(t, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.21\n",
+		"a/a.go": "package a\n\nfunc A() int { return 1 }\n",
+		"a/c.go": "package a\n\nvar C int = \"c\"\n",
+	})
+	// c.go was broken before, and GPT can't fix it, so a good change
+	// to a.go needs no corrective round
+	good := fileResponse("a/a.go", "go", "package a\n\nfunc A() int { return 2 }\n")
+	llm := &scriptedProvider{responses: []string{good}}
+	p := &Prompt{In: []string{"a/"}, Out: []string{"a/a.go"}, Txt: "return 2"}
+	rec, err := getChanges(defaultConfig(), llm, p)
+	if err != nil {
+		t.Fatalf("getChanges failed: %v", err)
+	}
+	if len(llm.requests) != 1 || len(rec.Corrections) != 0 {
+		t.Errorf("expected no corrective rounds, got %#v", rec.Corrections)
+	}
+}
@@ -0,0 +1,141 @@
+package x3
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	. "github.com/stevegt/goadapt"
+)
+
+// attachWatch is the name of the prompt attachment that reports what
+// the last watch round did
+const attachWatch = "watch.txt"
+
+// watchSteps are the subcommands that may appear in the watch
+// setting
+var watchSteps = []string{"commit", "prompt", "apply", "test"}
+
+// parseWatchSteps splits the watch setting into steps
+func parseWatchSteps(setting string) (steps []string, err error) {
+	defer Return(&err)
+	steps = splitList(setting)
+	Assert(len(steps) > 0, "the watch setting is empty")
+	for _, step := range steps {
+		ok := false
+		for _, s := range watchSteps {
+			ok = ok || step == s
+		}
+		Assert(ok, "unknown watch step %q; expected some of %s", step, strings.Join(watchSteps, ", "))
+	}
+	return
+}
+
+// watchPrompt runs the steps in the watch setting each time the
+// prompt file is saved, and never returns unless the watcher fails.
+// Each round's results are written back to the prompt file, so the
+// user can iterate from an editor without touching the shell.
+func watchPrompt(cfg *Config, llm Provider, promptFn string) (err error) {
+	defer Return(&err)
+	steps, err := parseWatchSteps(cfg.Watch)
+	Ck(err)
+	watcher, err := fsnotify.NewWatcher()
+	Ck(err)
+	defer watcher.Close()
+	// watch the directory rather than the file, because many editors
+	// save by renaming a new file over the old one
+	err = watcher.Add(filepath.Dir(promptFn))
+	Ck(err)
+
+	// last is the hash of the prompt file as of the end of the last
+	// round, so we can skip the events caused by our own writes
+	var last string
+	for {
+		Pf("Watching %s; running %s on each save\n", promptFn, strings.Join(steps, ", "))
+		err = waitForFile(watcher, promptFn, last)
+		Ck(err)
+		// the save may have been undone while the writes settled
+		hash, err := hashFile(promptFn)
+		Ck(err)
+		if hash == last {
+			continue
+		}
+		err = runWatchRound(cfg, llm, promptFn, steps)
+		Ck(err)
+		last, err = hashFile(promptFn)
+		Ck(err)
+	}
+}
+
+// runWatchRound runs steps once and attaches a report of each step to
+// the prompt file.  A failed step ends the round but is only reported,
+// so the watch keeps going.
+func runWatchRound(cfg *Config, llm Provider, promptFn string, steps []string) (err error) {
+	defer Return(&err)
+	var report strings.Builder
+	Fpf(&report, "Round started %s\n", time.Now().Format(time.RFC1123))
+	for _, step := range steps {
+		Pl("aidda: watch: running", step)
+		res, stepErr := runWatchStep(cfg, llm, promptFn, step)
+		if stepErr != nil {
+			Pf("aidda: watch: %s failed: %v\n", step, stepErr)
+			Fpf(&report, "%s: failed: %v\n", step, stepErr)
+			break
+		}
+		Fpf(&report, "%s: %s\n", step, res)
+	}
+	err = setPromptAttachment(promptFn, attachWatch, report.String())
+	Ck(err)
+	return
+}
+
+// runWatchStep runs a single watch step and returns a one-line
+// result
+func runWatchStep(cfg *Config, llm Provider, promptFn, step string) (res string, err error) {
+	defer Return(&err)
+	switch step {
+	case "commit":
+		err = commit(cfg, llm, promptFn)
+		if errors.Is(err, errGateFailed) {
+			// let the prompt step ask GPT to fix it
+			return "blocked by the quality gate", nil
+		}
+		Ck(err)
+		res = "done"
+	case "prompt":
+		p, err := readPrompt(promptFn)
+		Ck(err)
+		_, err = getChanges(cfg, llm, p)
+		Ck(err)
+		manifest, err := readPending()
+		Ck(err)
+		res = "nothing staged"
+		if manifest != nil {
+			res = Spf("staged %d files", len(manifest.Files))
+		}
+	case "apply":
+		manifest, err := readPending()
+		Ck(err)
+		if manifest == nil {
+			res = "nothing to apply"
+			break
+		}
+		applied, conflicts, err := applyPending(false)
+		Ck(err)
+		Assert(len(conflicts) == 0, "changed since the response was staged: %s; run 'show', 'apply', or 'reject'",
+			strings.Join(conflicts, ", "))
+		err = attachLastDiff(promptFn)
+		Ck(err)
+		res = Spf("applied %s", strings.Join(applied, ", "))
+	case "test":
+		report, testRes, err := runTest(cfg, promptFn)
+		Ck(err)
+		pass, fail, skip := report.Counts()
+		res = Spf("%d passed, %d failed, %d skipped, %s", pass, fail, skip, testRes.Status())
+	default:
+		Assert(false, "unknown watch step %q", step)
+	}
+	return
+}
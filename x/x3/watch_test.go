@@ -0,0 +1,120 @@
+package x3
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestParseWatchSteps(t *testing.T) {
+	steps, err := parseWatchSteps("prompt, apply,test")
+	if err != nil {
+		t.Fatalf("parseWatchSteps failed: %v", err)
+	}
+	if strings.Join(steps, ",") != "prompt,apply,test" {
+		t.Errorf("Unexpected steps: %v", steps)
+	}
+	for _, setting := range []string{"", "prompt,loop"} {
+		_, err = parseWatchSteps(setting)
+		if err == nil {
+			t.Errorf("Expected %q to be rejected", setting)
+		}
+	}
+}
+
+func TestRunWatchRound(t *testing.T) {
+	chdirTemp(t, map[string]string{"a.go": "package a\n"})
+	gitInit(t)
+	promptFn := ".aidda/prompt"
+	err := writePrompt(promptFn, &Prompt{In: []string{"a.go"}, Out: []string{"a.go"}, Txt: "add func A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package a\n\nfunc A() {}\n"
+	llm := &scriptedProvider{responses: []string{fileResponse("a.go", "go", want)}}
+	// the temporary tree isn't a Go module, so go vet would fail
+	cfg := defaultConfig()
+	cfg.Gate = gateOff
+	err = runWatchRound(cfg, llm, promptFn, []string{"prompt", "apply", "commit"})
+	if err != nil {
+		t.Fatalf("runWatchRound failed: %v", err)
+	}
+	got, err := os.ReadFile("a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("Expected a.go to be %q, got: %q", want, got)
+	}
+	p, err := readPrompt(promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, ok := p.Attachment(attachWatch)
+	if !ok {
+		t.Fatalf("Expected a %s attachment", attachWatch)
+	}
+	for _, line := range []string{"prompt: staged 1 files", "apply: applied a.go", "commit: done"} {
+		if !strings.Contains(report, line) {
+			t.Errorf("Expected report to contain %q, got: %q", line, report)
+		}
+	}
+
+	// a failed step ends the round, and is reported rather than
+	// returned
+	err = runWatchRound(defaultConfig(), llm, promptFn, []string{"prompt", "apply"})
+	if err != nil {
+		t.Fatalf("runWatchRound failed: %v", err)
+	}
+	p, err = readPrompt(promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, _ = p.Attachment(attachWatch)
+	if !strings.Contains(report, "prompt: failed") || strings.Contains(report, "apply:") {
+		t.Errorf("Expected the round to stop at prompt, got: %q", report)
+	}
+}
+
+func TestWaitForFile(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{".aidda/prompt": "prompt\n"})
+	promptFn := filepath.Join(dir, ".aidda", "prompt")
+	skip, err := hashFile(promptFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	err = watcher.Add(filepath.Dir(promptFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- waitForFile(watcher, promptFn, skip) }()
+
+	// writes to other files, and writes that leave the prompt file
+	// as it was, don't count
+	os.WriteFile(filepath.Join(dir, ".aidda", "history"), []byte("x\n"), 0644)
+	os.WriteFile(promptFn, []byte("prompt\n"), 0644)
+	select {
+	case err := <-done:
+		t.Fatalf("Expected waitForFile to keep waiting, got: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	os.WriteFile(promptFn, []byte("new prompt\n"), 0644)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("waitForFile failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected waitForFile to return after the prompt changed")
+	}
+}